@@ -0,0 +1,80 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"strings"
+)
+
+// An AdmonitionRenderer renders the admonitions of a type, such as note or
+// warning, given the tokens of their titles and their content.
+type AdmonitionRenderer interface {
+	RenderAdmonition(kind string, title, body []*html.Token) []*html.Token
+}
+
+// An AdmonitionRendererFunc is a function used as an AdmonitionRenderer.
+type AdmonitionRendererFunc func(kind string, title, body []*html.Token) []*html.Token
+
+func (f AdmonitionRendererFunc) RenderAdmonition(kind string, title, body []*html.Token) []*html.Token {
+	return f(kind, title, body)
+}
+
+// DefaultAdmonition renders an admonition as
+// <div class="admonition note"><p class="admonition-title">Note</p>...</div>,
+// the markup Python-Markdown and MkDocs use, so that their stylesheets work.
+// It's used for the types that aren't in Options.Admonitions.
+func DefaultAdmonition(kind string, title, body []*html.Token) []*html.Token {
+	tokens := []*html.Token{{Type: html.StartTagToken, DataAtom: atom.Div, Data: "div",
+		Attr: []html.Attribute{{Key: "class", Val: "admonition " + kind}}}}
+	if len(title) > 0 {
+		tokens = append(tokens, startAdmonitionTitle)
+		tokens = append(tokens, title...)
+		tokens = append(tokens, endP)
+	}
+	tokens = append(tokens, body...)
+	return append(tokens, endDiv)
+}
+
+// parseAdmonition parses a container of a type, such as note, warning, tip,
+// problem or solution, and renders it with the type's AdmonitionRenderer.
+func (p *Parser) parseAdmonition(tok *Token) {
+	p.block()
+	kind, title, body := p.parseContainer(tok)
+	renderer := p.opts.Admonitions[kind]
+	if renderer == nil {
+		renderer = AdmonitionRendererFunc(DefaultAdmonition)
+	}
+	p.tokens = append(p.tokens, renderer.RenderAdmonition(kind, title, body)...)
+}
+
+// parseContainer parses the title and content of an admonition or
+// collapsible block, and returns them with its type. The content is parsed
+// as a document of its own. The title defaults to the type, and an empty
+// quoted title, as in !!! note "", leaves it out.
+func (p *Parser) parseContainer(tok *Token) (string, []*html.Token, []*html.Token) {
+	header, body := tok.Lit, ""
+	if i := strings.IndexByte(tok.Lit, '\n'); i >= 0 {
+		header, body = tok.Lit[:i], tok.Lit[i+1:]
+	}
+	kind, title, _ := strings.Cut(header, " ")
+	kind = strings.ToLower(kind)
+	title = strings.TrimSpace(title)
+	offset := p.litOffset(p.pos-1, title)
+	if len(title) >= 2 && (title[0] == '"' || title[0] == '\'') && title[len(title)-1] == title[0] {
+		title = title[1 : len(title)-1]
+		offset++
+	} else if title == "" {
+		title = strings.ToUpper(kind[:1]) + kind[1:]
+	}
+	var titleTokens []*html.Token
+	if title != "" {
+		titleTokens = p.inlineTokens(title, offset)
+	}
+	raw := strings.TrimLeft(tok.Raw, "\n")
+	bodyOffset := p.offsets[p.pos-1] + len(tok.Raw) - len(raw) + lineEnd(raw, 0) + 1
+	src := ""
+	if bodyOffset <= p.offsets[p.pos-1]+len(tok.Raw) {
+		src = tok.Raw[bodyOffset-p.offsets[p.pos-1]:]
+	}
+	return kind, titleTokens, p.parseNested(body, lineStarts(body, src, bodyOffset))
+}
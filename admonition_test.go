@@ -0,0 +1,105 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"testing"
+)
+
+func TestAdmonitions(t *testing.T) {
+	cases := []struct {
+		input, want string
+	}{
+		{
+			":::note\nSome *text*.\n\n- a\n- b\n:::\n\nAfter",
+			"<div class=\"admonition note\">\n" +
+				"\t<p class=\"admonition-title\">Note</p>\n" +
+				"\t<p>Some <em>text</em>.</p>\n" +
+				"\t<ul>\n\t\t<li>a</li>\n\t\t<li>b</li>\n\t</ul>\n" +
+				"</div>\n" +
+				"<p>After</p>",
+		},
+		{
+			"!!! warning \"Be *careful*\"\n    One\n\n    Two\n\nAfter",
+			"<div class=\"admonition warning\">\n" +
+				"\t<p class=\"admonition-title\">Be <em>careful</em></p>\n" +
+				"\t<p>One</p>\n" +
+				"\t<p>Two</p>\n" +
+				"</div>\n" +
+				"<p>After</p>",
+		},
+		{
+			"::: tip Nested\n:::note\n```\n:::\n```\n:::\nOuter\n:::",
+			"<div class=\"admonition tip\">\n" +
+				"\t<p class=\"admonition-title\">Nested</p>\n" +
+				"\t<div class=\"admonition note\">\n" +
+				"\t\t<p class=\"admonition-title\">Note</p>\n" +
+				"\t\t<pre><code>:::</code></pre>\n" +
+				"\t</div>\n" +
+				"\t<p>Outer</p>\n" +
+				"</div>",
+		},
+		{
+			"!!! solution \"\"\n\tx = 1\n\n> :::problem\n> Unclosed",
+			"<div class=\"admonition solution\">\n" +
+				"\t<p>x = 1</p>\n" +
+				"</div>\n" +
+				"<blockquote>\n" +
+				"\t<div class=\"admonition problem\">\n" +
+				"\t\t<p class=\"admonition-title\">Problem</p>\n" +
+				"\t\t<p>Unclosed</p>\n" +
+				"\t</div>\n" +
+				"</blockquote>",
+		},
+		{
+			"!!! note\n::: \n!!! 1",
+			"<div class=\"admonition note\">\n" +
+				"\t<p class=\"admonition-title\">Note</p>\n" +
+				"</div>\n" +
+				"<p>:::\n!!! 1</p>",
+		},
+		{
+			"!!!Wow that was great\n\n!!!\tnote",
+			"<p>!!!Wow that was great</p>\n" +
+				"<div class=\"admonition note\">\n" +
+				"\t<p class=\"admonition-title\">Note</p>\n" +
+				"</div>",
+		},
+	}
+	for _, c := range cases {
+		if got := Markdown(c.input); got != c.want {
+			t.Errorf("%q: got\n%s\nwant\n%s", c.input, got, c.want)
+		}
+	}
+}
+
+func TestAdmonitionRenderers(t *testing.T) {
+	div := func(class string) *html.Token {
+		return &html.Token{Type: html.StartTagToken, DataAtom: atom.Div, Data: "div",
+			Attr: []html.Attribute{{Key: "class", Val: class}}}
+	}
+	panel := AdmonitionRendererFunc(func(kind string, title, body []*html.Token) []*html.Token {
+		tokens := []*html.Token{div("panel panel-default"), div("panel-heading"), startH2}
+		tokens = append(tokens, title...)
+		tokens = append(tokens, endH2, endDiv, div("panel-body"))
+		tokens = append(tokens, body...)
+		return append(tokens, endDiv, endDiv)
+	})
+	opts := &Options{Admonitions: map[string]AdmonitionRenderer{"problem": panel}}
+	input := ":::problem Problem 4.1\nThe radius of the earth is 6,378.14 km.\n:::\n\n:::note\nA note.\n:::"
+	want := "<div class=\"panel panel-default\">\n" +
+		"\t<div class=\"panel-heading\">\n" +
+		"\t\t<h2>Problem 4.1</h2>\n" +
+		"\t</div>\n" +
+		"\t<div class=\"panel-body\">\n" +
+		"\t\t<p>The radius of the earth is 6,378.14 km.</p>\n" +
+		"\t</div>\n" +
+		"</div>\n" +
+		"<div class=\"admonition note\">\n" +
+		"\t<p class=\"admonition-title\">Note</p>\n" +
+		"\t<p>A note.</p>\n" +
+		"</div>"
+	if got, _ := MarkdownWithOptions(input, opts); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
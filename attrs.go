@@ -0,0 +1,219 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// spanAttrsRe matches an attribute list directly after a link, image or
+	// emphasis, as in [Download](file.zip){.btn}.
+	spanAttrsRe = regexp.MustCompile(`^\{:?([^{}\n]*)\}`)
+	// headerAttrsRe matches an attribute list at the end of a header, as in
+	// "# Introduction {#intro .lead}".
+	headerAttrsRe = regexp.MustCompile(`[\t ]*\{:?([^{}\n]*)\}[\t ]*$`)
+	// blockAttrsRe matches an attribute list on the line after a block, as
+	// in "{: .table-striped}".
+	blockAttrsRe = regexp.MustCompile(`^[\t ]*\{:([^{}\n]*)\}[\t ]*$`)
+	// attrNameRe matches the name of an attribute in an attribute list.
+	attrNameRe = regexp.MustCompile(`^[A-Za-z_:][-A-Za-z0-9_:.]*$`)
+)
+
+// parseAttrList parses the inside of an attribute list, such as
+// "#intro .lead data-x=1", and reports whether it is one: a list of .class,
+// #id and key=value attributes, where the value may be quoted and the key
+// must be a valid attribute name.
+func parseAttrList(s string) ([]html.Attribute, bool) {
+	var attrs []html.Attribute
+	for i := 0; i < len(s); {
+		if s[i] == ' ' || s[i] == '\t' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && strings.IndexByte(" \t=", s[j]) < 0 {
+			j++
+		}
+		key := s[i:j]
+		switch {
+		case len(key) > 1 && key[0] == '.':
+			attrs = addClass(attrs, key[1:])
+		case len(key) > 1 && key[0] == '#':
+			attrs = setAttr(attrs, "id", key[1:])
+		case attrNameRe.MatchString(key) && j < len(s) && s[j] == '=':
+			var val string
+			val, j = infoValue(s, j+1)
+			if key == "class" {
+				attrs = addClass(attrs, val)
+			} else {
+				attrs = setAttr(attrs, key, val)
+			}
+		default:
+			return nil, false
+		}
+		i = j
+	}
+	return attrs, len(attrs) > 0
+}
+
+// setAttr sets the value of the attribute key in attrs.
+func setAttr(attrs []html.Attribute, key, val string) []html.Attribute {
+	for i, attr := range attrs {
+		if attr.Key == key {
+			attrs[i].Val = val
+			return attrs
+		}
+	}
+	return append(attrs, html.Attribute{Key: key, Val: val})
+}
+
+// withAttrs returns a copy of a start tag with attributes added to its own,
+// classes being added to its classes and the others replacing its values.
+// The tag isn't changed, since the parser's tags are shared.
+func withAttrs(tok *html.Token, attrs []html.Attribute) *html.Token {
+	merged := *tok
+	merged.Attr = append([]html.Attribute(nil), tok.Attr...)
+	for _, attr := range attrs {
+		if attr.Key == "class" {
+			for _, class := range strings.Fields(attr.Val) {
+				if !hasClass(merged.Attr, class) {
+					merged.Attr = addClass(merged.Attr, class)
+				}
+			}
+		} else {
+			merged.Attr = setAttr(merged.Attr, attr.Key, attr.Val)
+		}
+	}
+	return &merged
+}
+
+// hasClass reports whether attrs have the class.
+func hasClass(attrs []html.Attribute, class string) bool {
+	for _, attr := range attrs {
+		if attr.Key == "class" {
+			for _, c := range strings.Fields(attr.Val) {
+				if c == class {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// parseSpanAttrs parses an attribute list directly after a link, image or
+// emphasis, whose element is the first started after the nth token, and
+// removes it from the text it's at the start of.
+func (p *Parser) parseSpanAttrs(n int) {
+	next := p.peek()
+	if next.Type != TEXT {
+		return
+	}
+	m := spanAttrsRe.FindStringSubmatch(next.Raw)
+	if m == nil {
+		return
+	}
+	attrs, ok := parseAttrList(m[1])
+	if !ok {
+		return
+	}
+	for i := n; i < len(p.tokens); i++ {
+		tok := p.tokens[i]
+		if tok != startP && (tok.Type == html.StartTagToken || tok.Type == html.SelfClosingTagToken) {
+			p.tokens[i] = withAttrs(tok, attrs)
+			break
+		}
+	}
+	if rest := next.Raw[len(m[0]):]; rest != "" {
+		p.input[p.pos] = &Token{TEXT, unescape(rest), rest}
+		p.offsets[p.pos] += len(m[0])
+	} else {
+		p.next()
+	}
+}
+
+// headerAttrs removes an attribute list from the end of the text of a
+// header, whose tokens start at the start'th token, and adds its attributes
+// to the header's start tag.
+func (p *Parser) headerAttrs(start int) {
+	last := p.tokens[len(p.tokens)-1]
+	if len(p.tokens) == start+1 || last.Type != html.TextToken {
+		return
+	}
+	m := headerAttrsRe.FindStringSubmatchIndex(last.Data)
+	if m == nil {
+		return
+	}
+	attrs, ok := parseAttrList(last.Data[m[2]:m[3]])
+	if !ok {
+		return
+	}
+	p.tokens[start] = withAttrs(p.tokens[start], attrs)
+	if m[0] == 0 {
+		p.tokens = p.tokens[:len(p.tokens)-1]
+	} else {
+		p.tokens[len(p.tokens)-1] = text(last.Data[:m[0]])
+	}
+}
+
+// blockAttrList returns the attributes of the attribute list that's the
+// i'th input token, if it's on a line of its own, or nil. It's a table cell
+// when it follows a table.
+func (p *Parser) blockAttrList(i int) []html.Attribute {
+	if i >= len(p.input) || (p.input[i].Type != TEXT && p.input[i].Type != TD) {
+		return nil
+	}
+	// The block after it may start with the newline that ends it.
+	if i+1 < len(p.input) && !strings.HasPrefix(p.input[i+1].Raw, "\n") {
+		return nil
+	}
+	m := blockAttrsRe.FindStringSubmatch(p.input[i].Raw)
+	if m == nil {
+		return nil
+	}
+	attrs, _ := parseAttrList(m[1])
+	return attrs
+}
+
+// addBlockAttrs adds attributes to the element of the block before them,
+// ending the paragraph they follow, if any, and reports whether there was
+// a block.
+func (p *Parser) addBlockAttrs(attrs []html.Attribute) bool {
+	p.block()
+	last := len(p.tokens) - 1
+	if last < 0 || p.tokens[last].Type != html.EndTagToken {
+		return false
+	}
+	// The start of a block given several attribute lists is only searched
+	// for once.
+	if b := p.attrsBlock; b.end == last && b.start < last && p.tokens[b.start] == b.tok {
+		p.tokens[b.start] = withAttrs(b.tok, attrs)
+		p.attrsBlock.tok = p.tokens[b.start]
+		return true
+	}
+	end, depth := p.tokens[last], 0
+	for i := last; i >= 0; i-- {
+		tok := p.tokens[i]
+		if tok.Data != end.Data || tok.Type == html.TextToken {
+			continue
+		}
+		if tok.Type == html.EndTagToken {
+			depth++
+		} else if tok.Type == html.StartTagToken {
+			if depth--; depth == 0 {
+				p.tokens[i] = withAttrs(tok, attrs)
+				p.attrsBlock = attrsBlock{p.tokens[i], i, last}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attrsBlock is the block attributes were last added to, with the indexes of
+// its start and end tags.
+type attrsBlock struct {
+	tok        *html.Token
+	start, end int
+}
@@ -0,0 +1,74 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"reflect"
+	"testing"
+)
+
+func TestParseAttrList(t *testing.T) {
+	cases := []struct {
+		input string
+		want  []html.Attribute
+		ok    bool
+	}{
+		{"#intro .lead", []html.Attribute{{Key: "id", Val: "intro"}, {Key: "class", Val: "lead"}}, true},
+		{" .a\t.b class=c ", []html.Attribute{{Key: "class", Val: "a b c"}}, true},
+		{`width=50 title="A title" #x #y`,
+			[]html.Attribute{{Key: "width", Val: "50"}, {Key: "title", Val: "A title"}, {Key: "id", Val: "y"}}, true},
+		{"", nil, false},
+		{"not attrs", nil, false},
+		{". #", nil, false},
+		{`a"b=2`, nil, false},
+		{"data-x=1 -y=2", nil, false},
+	}
+	for _, c := range cases {
+		got, ok := parseAttrList(c.input)
+		if !reflect.DeepEqual(got, c.want) || ok != c.ok {
+			t.Errorf("%q: got %v, %v, want %v, %v", c.input, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestAttributeLists(t *testing.T) {
+	cases := []struct {
+		input, want string
+	}{
+		{
+			"# Introduction {#intro .lead}\n\n## C# {not attrs}\n\n### *Emphasis*{.em} {.h}",
+			"<h1 id=\"intro\" class=\"lead\">Introduction</h1>\n" +
+				"<h2>C# {not attrs}</h2>\n" +
+				"<h3 class=\"h\"><em class=\"em\">Emphasis</em></h3>",
+		},
+		{
+			"Col1 | Col2\n---- | ----\nFoo  | Bar\n{: .table-striped}\n{: .table #t}\n\nAfter",
+			"<table class=\"table-striped table\" id=\"t\">\n" +
+				"\t<tr>\n\t\t<th>Col1</th>\n\t\t<th>Col2</th>\n\t</tr>\n" +
+				"\t<tr>\n\t\t<td>Foo</td>\n\t\t<td>Bar</td>\n\t</tr>\n" +
+				"</table>\n" +
+				"<p>After</p>",
+		},
+		{
+			"A paragraph\n{: .lead}\n\n> Quote\n{: .quote .lead}\n\n- a\n- b\n{: .list}",
+			"<p class=\"lead\">A paragraph</p>\n" +
+				"<blockquote class=\"quote lead\">\n\t<p>Quote</p>\n</blockquote>\n" +
+				"<ul class=\"list\">\n\t<li>a</li>\n\t<li>b</li>\n</ul>",
+		},
+		{
+			"[Download](file.zip){.btn .btn-primary} ![Logo](logo.png){width=50} *a*{#em}b **c**{: .d}",
+			"<p><a href=\"file.zip\" class=\"btn btn-primary\">Download</a> " +
+				"<img alt=\"Logo\" src=\"logo.png\" width=\"50\"/> " +
+				"<em id=\"em\">a</em>b <strong class=\"d\">c</strong></p>",
+		},
+		{
+			"{: .nothing}\n\ntext {.x}\n{: not attrs}",
+			"<p>{: .nothing}</p>\n" +
+				"<p>text {.x}\n{: not attrs}</p>",
+		},
+	}
+	for _, c := range cases {
+		if got := Markdown(c.input); got != c.want {
+			t.Errorf("%q: got\n%s\nwant\n%s", c.input, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"strconv"
+	"strings"
+)
+
+// codeInfo is what the info string after an opening code fence says about
+// the block, as in "go {linenos=true hl_lines=[3,5]} title=main.go".
+type codeInfo struct {
+	lang string
+	// linenos numbers the lines from start, and the lines in hlLines are
+	// highlighted.
+	linenos bool
+	start   int
+	hlLines [][2]int
+	// title is shown in a caption above the block.
+	title string
+	// attrs are the other attributes, which are put on the pre element.
+	attrs []html.Attribute
+	// all is every attribute, for a CodeRenderer.
+	all []html.Attribute
+}
+
+// A CodeRenderer renders the fenced code blocks of a language as something
+// other than a pre element, such as a diagram or an embed. It's given the
+// code and the attributes from the info string after the opening fence, and
+// returns HTML.
+type CodeRenderer interface {
+	RenderCode(code string, attrs []html.Attribute) (string, error)
+}
+
+// A CodeRendererFunc is a function used as a CodeRenderer.
+type CodeRendererFunc func(code string, attrs []html.Attribute) (string, error)
+
+func (f CodeRendererFunc) RenderCode(code string, attrs []html.Attribute) (string, error) {
+	return f(code, attrs)
+}
+
+// parseCodeInfo parses an info string: a language followed by attributes,
+// which may be inside braces. An attribute is a key=value pair, where the
+// value may be quoted or a list in brackets, a key alone, or a .class or #id.
+func (p *Parser) parseCodeInfo(s string) *codeInfo {
+	s = strings.TrimSpace(s)
+	info := &codeInfo{start: 1}
+	end := strings.IndexAny(s, " \t{")
+	if end < 0 {
+		end = len(s)
+	}
+	info.lang = s[:end]
+	for i := end; i < len(s); {
+		if strings.IndexByte(" \t,{}", s[i]) >= 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && strings.IndexByte(" \t,{}=", s[j]) < 0 {
+			j++
+		}
+		key, val := s[i:j], ""
+		if j < len(s) && s[j] == '=' {
+			val, j = infoValue(s, j+1)
+		}
+		i = j
+		switch {
+		case key == "":
+			continue
+		case strings.HasPrefix(key, "."):
+			info.all = addClass(info.all, key[1:])
+			continue
+		case key == "class":
+			info.all = addClass(info.all, val)
+			continue
+		case strings.HasPrefix(key, "#"):
+			key, val = "id", key[1:]
+		case key == "linenos":
+			info.linenos = val != "false"
+		case key == "linenostart":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				p.warnf(p.pos-1, "bad linenostart %q", val)
+				break
+			}
+			info.start = n
+		case key == "hl_lines":
+			ranges, ok := lineRanges(val)
+			if !ok {
+				p.warnf(p.pos-1, "bad hl_lines %q", val)
+			}
+			info.hlLines = append(info.hlLines, ranges...)
+		case key == "title" || key == "filename":
+			info.title = val
+		}
+		info.all = append(info.all, html.Attribute{Key: key, Val: val})
+	}
+	for _, attr := range info.all {
+		if !codeInfoKeys[attr.Key] {
+			info.attrs = append(info.attrs, attr)
+		}
+	}
+	return info
+}
+
+// codeInfoKeys are the attributes in an info string that configure the
+// block, rather than being put on its pre element.
+var codeInfoKeys = map[string]bool{
+	"linenos":     true,
+	"linenostart": true,
+	"hl_lines":    true,
+	"title":       true,
+	"filename":    true,
+}
+
+// infoValue returns the value starting at s[i] and the index after it. The
+// quotes around a quoted value are removed, but a list keeps its brackets.
+func infoValue(s string, i int) (string, int) {
+	if i >= len(s) {
+		return "", i
+	}
+	switch c := s[i]; c {
+	case '"', '\'':
+		if j := strings.IndexByte(s[i+1:], c); j >= 0 {
+			return s[i+1 : i+1+j], i + j + 2
+		}
+		return s[i+1:], len(s)
+	case '[':
+		if j := strings.IndexByte(s[i:], ']'); j >= 0 {
+			return s[i : i+j+1], i + j + 1
+		}
+		return s[i:], len(s)
+	}
+	j := i
+	for j < len(s) && strings.IndexByte(" \t,{}", s[j]) < 0 {
+		j++
+	}
+	return s[i:j], j
+}
+
+// addClass adds class to the class attribute in attrs.
+func addClass(attrs []html.Attribute, class string) []html.Attribute {
+	for i, attr := range attrs {
+		if attr.Key == "class" {
+			attrs[i].Val += " " + class
+			return attrs
+		}
+	}
+	return append(attrs, html.Attribute{Key: "class", Val: class})
+}
+
+// lineRanges parses a list of line numbers and ranges such as [3,5-7] or
+// "3 5-7".
+func lineRanges(s string) ([][2]int, bool) {
+	var ranges [][2]int
+	for _, r := range strings.FieldsFunc(s, func(c rune) bool {
+		return strings.ContainsRune("[]\"' ,", c)
+	}) {
+		from, to := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			from, to = r[:i], r[i+1:]
+		}
+		a, err := strconv.Atoi(from)
+		if err != nil {
+			return ranges, false
+		}
+		b, err := strconv.Atoi(to)
+		if err != nil || a < 1 || b < a {
+			return ranges, false
+		}
+		ranges = append(ranges, [2]int{a, b})
+	}
+	return ranges, true
+}
+
+// highlightedLines returns which of the lines, numbered from 1 to n, are
+// highlighted.
+func (info *codeInfo) highlightedLines(n int) []bool {
+	// Mark where each range starts and ends, and add up the marks, so that
+	// overlapping ranges don't take longer.
+	marks := make([]int, n+2)
+	for _, r := range info.hlLines {
+		if r[0] <= n {
+			marks[r[0]]++
+			if r[1] < n {
+				marks[r[1]+1]--
+			} else {
+				marks[n+1]--
+			}
+		}
+	}
+	highlighted := make([]bool, n+1)
+	count := 0
+	for line := 1; line <= n; line++ {
+		count += marks[line]
+		highlighted[line] = count > 0
+	}
+	return highlighted
+}
+
+func (p *Parser) parseCodeBlock(tok *Token) error {
+	info, code := &codeInfo{}, tok.Lit
+	codeStart := startCode
+	if i := strings.IndexByte(tok.Lit, '\n'); i >= 0 {
+		info, code = p.parseCodeInfo(tok.Lit[:i]), tok.Lit[i+1:]
+	}
+	// A block without a language has no class.
+	if info.lang != "" {
+		codeStart = &html.Token{
+			Type:     html.StartTagToken,
+			DataAtom: atom.Code,
+			Data:     "code",
+			Attr: []html.Attribute{
+				{Key: "class", Val: info.lang},
+			},
+		}
+	}
+	code = strings.TrimSpace(code)
+	if r := p.opts.CodeRenderers[info.lang]; r != nil && info.lang != "" {
+		out, err := r.RenderCode(code, info.all)
+		if err == nil {
+			p.tokens = append(p.tokens, htmlTokens(out)...)
+			return nil
+		}
+		p.warnf(p.pos-1, "can't render %s code block: %v", info.lang, err)
+	}
+	var tokens []*html.Token
+	if h := p.opts.Highlighters[info.lang]; h != nil && info.lang != "" {
+		tokens = h.Highlight(code)
+	} else {
+		tokens = []*html.Token{text(code)}
+	}
+	if info.linenos || len(info.hlLines) > 0 {
+		tokens = info.splitLines(tokens)
+	}
+	if info.title != "" {
+		p.append(startCodeFigure)
+		p.append(startFigcaption)
+		p.append(text(info.title))
+		p.append(endFigcaption)
+	}
+	if len(info.attrs) > 0 {
+		p.append(&html.Token{Type: html.StartTagToken, DataAtom: atom.Pre, Data: "pre", Attr: info.attrs})
+	} else {
+		p.append(startPre)
+	}
+	p.append(codeStart)
+	p.tokens = append(p.tokens, tokens...)
+	p.append(endCode)
+	p.append(endPre)
+	if info.title != "" {
+		p.append(endFigure)
+	}
+	return nil
+}
+
+// splitLines wraps each line of the code in a span, with its number if the
+// lines are numbered. The spans of highlighted lines have the class
+// "highlighted". The elements the highlighter put around a line break are
+// closed at the end of the line and opened again at the start of the next,
+// so that the elements nest properly.
+func (info *codeInfo) splitLines(tokens []*html.Token) []*html.Token {
+	n := 1
+	for _, tok := range tokens {
+		if tok.Type == html.TextToken {
+			n += strings.Count(tok.Data, "\n")
+		}
+	}
+	highlighted := info.highlightedLines(n)
+	var out, open []*html.Token
+	line := 1
+	startLine := func() {
+		class := "line"
+		if highlighted[line] {
+			class += " highlighted"
+		}
+		out = append(out, &html.Token{Type: html.StartTagToken, DataAtom: atom.Span, Data: "span",
+			Attr: []html.Attribute{{Key: "class", Val: class}}})
+		if info.linenos {
+			out = append(out, startLineNumber, text(strconv.Itoa(info.start+line-1)), endSpan)
+		}
+		out = append(out, open...)
+	}
+	startLine()
+	for _, tok := range tokens {
+		switch tok.Type {
+		case html.StartTagToken:
+			open = append(open, tok)
+		case html.EndTagToken:
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		case html.TextToken:
+			for i, s := range strings.Split(tok.Data, "\n") {
+				if i > 0 {
+					for j := len(open) - 1; j >= 0; j-- {
+						out = append(out, &html.Token{Type: html.EndTagToken, DataAtom: open[j].DataAtom, Data: open[j].Data})
+					}
+					out = append(out, text("\n"), endSpan)
+					line++
+					startLine()
+				}
+				if s != "" {
+					out = append(out, text(s))
+				}
+			}
+			continue
+		}
+		out = append(out, tok)
+	}
+	return append(out, endSpan)
+}
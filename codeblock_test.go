@@ -0,0 +1,120 @@
+package markdown
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/html"
+	"reflect"
+	"testing"
+)
+
+var codeInfoCases = []struct {
+	info string
+	want codeInfo
+}{
+	{"", codeInfo{start: 1}},
+	{"go", codeInfo{lang: "go", start: 1}},
+	{
+		"go {linenos=true hl_lines=[3,5-7]} title=main.go",
+		codeInfo{lang: "go", linenos: true, start: 1, hlLines: [][2]int{{3, 3}, {5, 7}}, title: "main.go", all: []html.Attribute{
+			{Key: "linenos", Val: "true"},
+			{Key: "hl_lines", Val: "[3,5-7]"},
+			{Key: "title", Val: "main.go"},
+		}},
+	},
+	{
+		"js{.wide .dark, #ex linenostart=10 linenos hl_lines=\"2 4\"}",
+		codeInfo{lang: "js", linenos: true, start: 10, hlLines: [][2]int{{2, 2}, {4, 4}}, attrs: []html.Attribute{
+			{Key: "class", Val: "wide dark"},
+			{Key: "id", Val: "ex"},
+		}, all: []html.Attribute{
+			{Key: "class", Val: "wide dark"},
+			{Key: "id", Val: "ex"},
+			{Key: "linenostart", Val: "10"},
+			{Key: "linenos", Val: ""},
+			{Key: "hl_lines", Val: "2 4"},
+		}},
+	},
+	{
+		`sh filename="run it.sh" data-lang=bash linenos=false`,
+		codeInfo{lang: "sh", start: 1, title: "run it.sh", attrs: []html.Attribute{
+			{Key: "data-lang", Val: "bash"},
+		}, all: []html.Attribute{
+			{Key: "filename", Val: "run it.sh"},
+			{Key: "data-lang", Val: "bash"},
+			{Key: "linenos", Val: "false"},
+		}},
+	},
+}
+
+func TestParseCodeInfo(t *testing.T) {
+	p := &Parser{state: &parseState{}}
+	for _, c := range codeInfoCases {
+		if got := p.parseCodeInfo(c.info); !reflect.DeepEqual(*got, c.want) {
+			t.Errorf("%q: got %+v, want %+v", c.info, *got, c.want)
+		}
+	}
+}
+
+func TestCodeBlockLines(t *testing.T) {
+	cases := []struct {
+		input, want string
+	}{
+		{
+			"```go {linenos=true hl_lines=[2]} title=main.go\npackage main\n/* a\nb */\n```",
+			"<figure class=\"code-block\">\n" +
+				"\t<figcaption>main.go</figcaption>\n" +
+				"\t<pre><code class=\"go\">" +
+				"<span class=\"line\"><span class=\"line-number\">1</span><span class=\"token keyword\">package</span> main\n</span>" +
+				"<span class=\"line highlighted\"><span class=\"line-number\">2</span><span class=\"token comment\">/* a</span>\n</span>" +
+				"<span class=\"line\"><span class=\"line-number\">3</span><span class=\"token comment\">b */</span></span>" +
+				"</code></pre>\n" +
+				"</figure>",
+		},
+		{
+			"```text {hl_lines=[2-9] .out}\na\nb\nc\n```",
+			"<pre class=\"out\"><code class=\"text\">" +
+				"<span class=\"line\">a\n</span>" +
+				"<span class=\"line highlighted\">b\n</span>" +
+				"<span class=\"line highlighted\">c</span>" +
+				"</code></pre>",
+		},
+		{
+			"```{linenos=true}\na\n```",
+			"<pre><code><span class=\"line\"><span class=\"line-number\">1</span>a</span></code></pre>",
+		},
+	}
+	opts := &Options{Highlighters: DefaultHighlighters()}
+	for _, c := range cases {
+		if got, _ := MarkdownWithOptions(c.input, opts); got != c.want {
+			t.Errorf("got\n%s\nwant\n%s", got, c.want)
+		}
+	}
+}
+
+func TestCodeRenderers(t *testing.T) {
+	mermaid := CodeRendererFunc(func(code string, attrs []html.Attribute) (string, error) {
+		if code == "" {
+			return "", errors.New("no diagram")
+		}
+		var attr string
+		for _, a := range attrs {
+			attr += fmt.Sprintf(" data-%s=%q", a.Key, a.Val)
+		}
+		return fmt.Sprintf("<div class=\"mermaid\"%s>%s</div>", attr, html.EscapeString(code)), nil
+	})
+	opts := &Options{CodeRenderers: map[string]CodeRenderer{"mermaid": mermaid}}
+	input := "```mermaid {.wide theme=dark}\ngraph TD; A-->B\n```\n\n```mermaid\n```"
+	want := "<div class=\"mermaid\" data-class=\"wide\" data-theme=\"dark\">graph TD; A--&gt;B</div>\n" +
+		"<pre><code class=\"mermaid\"></code></pre>"
+	got, diags, err := MarkdownE(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if len(diags) != 1 || diags[0].String() != "5:1: can't render mermaid code block: no diagram" {
+		t.Errorf("got diagnostics %v", diags)
+	}
+}
@@ -0,0 +1,88 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"strings"
+)
+
+// pairedDirectives are the directives that are closed by another, as
+// <!--details--> is by <!--/details-->.
+var pairedDirectives = map[string]bool{
+	"details": true,
+	"raw":     true,
+}
+
+// parseDetails parses a collapsible block, as in "??? solution", whose type
+// is its class and whose title is its summary. "???+" starts it expanded.
+func (p *Parser) parseDetails(tok *Token) {
+	p.block()
+	kind, title, body := p.parseContainer(tok)
+	attrs := []html.Attribute{{Key: "class", Val: kind}}
+	if strings.HasPrefix(strings.TrimLeft(tok.Raw, "\n\t "), "???+") {
+		attrs = append(attrs, html.Attribute{Key: "open"})
+	}
+	p.appendDetails(attrs, title, body)
+}
+
+// parseDetailsDirective parses a details directive, which makes the content
+// up to the closing <!--/details--> collapsible, as in
+// <!--details summary="Solution"-->. The summary is inline Markdown, and
+// the other attributes, such as open, are put on the details element.
+func (p *Parser) parseDetailsDirective(attrs []html.Attribute) {
+	var summary []*html.Token
+	var detailsAttrs []html.Attribute
+	for _, attr := range attrs {
+		if attr.Key == "summary" {
+			summary = p.inlineTokens(attr.Val, p.litOffset(p.pos-1, attr.Val))
+		} else {
+			detailsAttrs = append(detailsAttrs, attr)
+		}
+	}
+	start := p.offsets[p.pos-1] + len(p.input[p.pos-1].Raw)
+	var src string
+	if end := p.closingDirective("details"); end >= 0 {
+		src = p.consumeTo(start, p.offsets[end])
+		p.next()
+	} else {
+		p.warnf(p.pos-1, "details directive has no <!--/details-->")
+		src = p.consumeTo(start, len(p.src))
+	}
+	p.block()
+	p.appendDetails(detailsAttrs, summary, p.parseNested(src, lineStarts(src, src, start)))
+}
+
+// closingDirective returns the index of the input token that closes the
+// directive the previous token opened, as <!--/details--> closes
+// <!--details-->, or -1 if it isn't closed. Directives of the same name may
+// be nested between them.
+func (p *Parser) closingDirective(name string) int {
+	depth := 0
+	for i := p.pos; i < len(p.input); i++ {
+		tok := p.input[i]
+		if tok.Type != HTML_TAG || !strings.HasPrefix(tok.Lit, "<!--") {
+			continue
+		}
+		comment := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(tok.Lit, "<!--"), "-->"))
+		if comment == "/"+name {
+			if depth == 0 {
+				return i
+			}
+			depth--
+		} else if m := directiveRe.FindStringSubmatch(comment); m != nil && m[1] == name {
+			depth++
+		}
+	}
+	return -1
+}
+
+func (p *Parser) appendDetails(attrs []html.Attribute, summary, body []*html.Token) {
+	p.append(&html.Token{Type: html.StartTagToken, DataAtom: atom.Details, Data: "details", Attr: attrs})
+	if len(summary) > 0 {
+		p.append(startSummary)
+		p.tokens = append(p.tokens, summary...)
+		p.append(endSummary)
+	}
+	p.tokens = append(p.tokens, body...)
+	p.append(endDetails)
+}
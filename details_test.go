@@ -0,0 +1,80 @@
+package markdown
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetails(t *testing.T) {
+	cases := []struct {
+		input, want string
+		diags       []string
+	}{
+		{
+			"???+ Solution\n    Use *v = sqrt(GM/r)*.\n\n??? note \"\"\n\tx",
+			"<details class=\"solution\" open=\"\">\n" +
+				"\t<summary>Solution</summary>\n" +
+				"\t<p>Use <em>v = sqrt(GM/r)</em>.</p>\n" +
+				"</details>\n" +
+				"<details class=\"note\">\n" +
+				"\t<p>x</p>\n" +
+				"</details>",
+			nil,
+		},
+		{
+			"<!--details summary=\"The *answer*\" open-->\n" +
+				"## Answer\n\n<!--details summary=\"More\"-->\ninner\n<!--/details-->\n<!--/details-->\n\nAfter",
+			"<details open=\"\">\n" +
+				"\t<summary>The <em>answer</em></summary>\n" +
+				"\t<h2>Answer</h2>\n" +
+				"\t<details>\n" +
+				"\t\t<summary>More</summary>\n" +
+				"\t\t<p>inner</p>\n" +
+				"\t</details>\n" +
+				"</details>\n" +
+				"<p>After</p>",
+			nil,
+		},
+		{
+			"???What do you mean\n\n???+Really",
+			"<p>???What do you mean</p>\n<p>???+Really</p>",
+			nil,
+		},
+		{
+			"<details>\n<summary>Raw *HTML*</summary>\n</details>",
+			"<details>\n" +
+				"\t<summary>Raw <em>HTML</em></summary>\n" +
+				"</details>",
+			nil,
+		},
+		{
+			"a <!--/details-->\n\n<!--details summary=\"[@x]\"-->\nunclosed",
+			"<p>a </p>\n" +
+				"<details>\n" +
+				"\t<summary><a href=\"#x\">??</a></summary>\n" +
+				"\t<p>unclosed</p>\n" +
+				"</details>",
+			[]string{
+				"1:3: <!--/details--> closes no details directive",
+				"3:1: details directive has no <!--/details-->",
+				"3:22: undefined reference to \"x\"",
+			},
+		},
+	}
+	for _, c := range cases {
+		got, diags, err := MarkdownE(c.input, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%q: got\n%s\nwant\n%s", c.input, got, c.want)
+		}
+		var msgs []string
+		for _, d := range diags {
+			msgs = append(msgs, d.String())
+		}
+		if !reflect.DeepEqual(msgs, c.diags) {
+			t.Errorf("%q: got diagnostics %q, want %q", c.input, msgs, c.diags)
+		}
+	}
+}
@@ -8,7 +8,15 @@ import (
 	"os"
 )
 
-var scan = flag.Bool("scan", false, "Print the lexical analysis.")
+var (
+	scan      = flag.Bool("scan", false, "Print the lexical analysis.")
+	hardWraps = flag.Bool("hard_wraps", false, "Render every newline in a paragraph as a line break.")
+	sanitize  = flag.Bool("sanitize", false, "Remove unsafe HTML, for untrusted input.")
+	mathML    = flag.Bool("mathml", false, "Convert math to MathML.")
+	highlight = flag.Bool("highlight", false, "Highlight the code in fenced code blocks.")
+	root      = flag.String("root", "", "The directory the files named by directives are read from. Directives can read any file in it, so leave it unset for untrusted input.")
+	eqSection = flag.Int("equation_section", 0, "Number equations within sections starting at headers of this level.")
+)
 
 func main() {
 	flag.Parse()
@@ -22,6 +30,28 @@ func main() {
 			fmt.Println(tok)
 		}
 	} else {
-		fmt.Println(markdown.Markdown(string(buf)))
+		opts := &markdown.Options{
+			HardWraps:       *hardWraps,
+			MathML:          *mathML,
+			EquationSection: *eqSection,
+		}
+		if *root != "" {
+			opts.FS = os.DirFS(*root)
+		}
+		if *highlight {
+			opts.Highlighters = markdown.DefaultHighlighters()
+		}
+		if *sanitize {
+			opts.Policy = markdown.DefaultPolicy()
+		}
+		out, diags, err := markdown.MarkdownE(string(buf), opts)
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(out)
 	}
 }
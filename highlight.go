@@ -0,0 +1,219 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"regexp"
+	"strings"
+)
+
+// A Highlighter highlights the code in a fenced code block, returning the
+// tokens to put inside its code element.
+type Highlighter interface {
+	Highlight(code string) []*html.Token
+}
+
+// A HighlighterFunc is a function used as a Highlighter.
+type HighlighterFunc func(code string) []*html.Token
+
+func (f HighlighterFunc) Highlight(code string) []*html.Token {
+	return f(code)
+}
+
+// DefaultHighlighters returns the built-in highlighters, for Go, JavaScript,
+// Python, shell, JSON and HTML, keyed by the languages they're named by after
+// a code fence. They wrap tokens in spans with the same classes as Prism, so
+// that its themes can be used, as in <span class="token keyword">.
+func DefaultHighlighters() map[string]Highlighter {
+	return map[string]Highlighter{
+		"go":         goLexer,
+		"golang":     goLexer,
+		"javascript": jsLexer,
+		"js":         jsLexer,
+		"python":     pythonLexer,
+		"py":         pythonLexer,
+		"sh":         shellLexer,
+		"shell":      shellLexer,
+		"bash":       shellLexer,
+		"json":       jsonLexer,
+		"html":       htmlLexer,
+		"xml":        htmlLexer,
+	}
+}
+
+// A lexer is a Highlighter that splits code into tokens with regular
+// expressions.
+type lexer []lexRule
+
+// A lexRule matches a token of a class at the start of the code. If re has a
+// group, only the group is given the class, and the rest of the match is
+// lexed again. A rule with no class matches plain text, such as identifiers that
+// keywords mustn't be found inside.
+//
+// The rules are written so that they never look further than they match,
+// for example by letting an unclosed string run to the end of its line, so
+// that highlighting takes linear time.
+type lexRule struct {
+	class string
+	re    *regexp.Regexp
+}
+
+func lexRuleFor(class, re string) lexRule {
+	return lexRule{class, regexp.MustCompile(`^(?:` + re + `)`)}
+}
+
+// words returns a pattern that matches any of the space-separated words.
+func words(list string) string {
+	return `(?:` + strings.Join(strings.Fields(list), "|") + `)\b`
+}
+
+func (l lexer) Highlight(code string) []*html.Token {
+	var tokens []*html.Token
+	plain := 0
+	flush := func(end int) {
+		if plain < end {
+			tokens = append(tokens, text(code[plain:end]))
+		}
+	}
+	for i := 0; i < len(code); {
+		matched := false
+		for _, r := range l {
+			m := r.re.FindStringSubmatchIndex(code[i:])
+			if m == nil {
+				continue
+			}
+			start, end := i, i+m[1]
+			if len(m) > 2 && m[2] >= 0 {
+				start, end = i+m[2], i+m[3]
+			}
+			if end == i {
+				continue
+			}
+			matched = true
+			if r.class != "" {
+				flush(start)
+				tokens = append(tokens, &html.Token{
+					Type:     html.StartTagToken,
+					DataAtom: atom.Span,
+					Data:     "span",
+					Attr:     []html.Attribute{{Key: "class", Val: "token " + r.class}},
+				})
+				tokens = append(tokens, text(code[start:end]))
+				tokens = append(tokens, endSpan)
+				plain = end
+			}
+			i = end
+			break
+		}
+		if !matched {
+			i++
+		}
+	}
+	flush(len(code))
+	return tokens
+}
+
+var (
+	cCommentPattern    = `//[^\n]*|(?s:/\*.*?(?:\*/|$))`
+	hashCommentPattern = `#[^\n]*`
+	dqStringPattern    = `"(?:[^"\\\n]|\\.)*"?`
+	sqStringPattern    = `'(?:[^'\\\n]|\\.)*'?`
+	numberPattern      = `(?:0[xXbBoO][0-9a-fA-F_]+|\d[\d_]*(?:\.[\d_]*)?(?:[eE][+-]?\d+)?|\.\d+(?:[eE][+-]?\d+)?)`
+	identifierPattern  = `[A-Za-z_$][\w$]*`
+	operatorPattern    = `[-+*/%&|^!=<>:]+|\.\.\.`
+	punctuationPattern = `[{}()\[\];,.]`
+)
+
+var goLexer = lexer{
+	lexRuleFor("", `\s+`),
+	lexRuleFor("comment", cCommentPattern),
+	lexRuleFor("string", dqStringPattern+"|`[^`]*`?"),
+	lexRuleFor("char", sqStringPattern),
+	lexRuleFor("keyword", words(`break case chan const continue default defer else
+		fallthrough for func go goto if import interface map package range return
+		select struct switch type var`)),
+	lexRuleFor("boolean", words(`true false`)),
+	lexRuleFor("constant", words(`nil iota`)),
+	lexRuleFor("builtin", words(`append cap close complex copy delete imag len make new
+		panic print println real recover bool byte complex64 complex128 error
+		float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16
+		uint32 uint64 uintptr any`)),
+	lexRuleFor("function", `(`+identifierPattern+`)\(`),
+	lexRuleFor("", identifierPattern),
+	lexRuleFor("number", numberPattern+`i?\b`),
+	lexRuleFor("operator", operatorPattern),
+	lexRuleFor("punctuation", punctuationPattern),
+}
+
+var jsLexer = lexer{
+	lexRuleFor("", `\s+`),
+	lexRuleFor("comment", cCommentPattern),
+	lexRuleFor("string", dqStringPattern+"|"+sqStringPattern+"|(?s:`(?:[^`\\\\]|\\\\.)*`?)"),
+	lexRuleFor("keyword", words(`async await break case catch class const continue
+		debugger default delete do else export extends finally for from function
+		if import in instanceof let new of return static super switch this throw
+		try typeof var void while with yield`)),
+	lexRuleFor("boolean", words(`true false`)),
+	lexRuleFor("constant", words(`null undefined NaN Infinity`)),
+	lexRuleFor("function", `(`+identifierPattern+`)\(`),
+	lexRuleFor("", identifierPattern),
+	lexRuleFor("number", numberPattern+`n?\b`),
+	lexRuleFor("operator", `[-+*/%&|^!=<>:?~]+|\.\.\.`),
+	lexRuleFor("punctuation", punctuationPattern),
+}
+
+var pythonLexer = lexer{
+	lexRuleFor("", `\s+`),
+	lexRuleFor("comment", hashCommentPattern),
+	lexRuleFor("string", `(?i:[rbuf]{0,2})(?s:"""(?:.*?)(?:"""|$)|'''(?:.*?)(?:'''|$))`),
+	lexRuleFor("string", `(?i:[rbuf]{0,2})(?:`+dqStringPattern+"|"+sqStringPattern+`)`),
+	lexRuleFor("decorator", `@[\w.]+`),
+	lexRuleFor("keyword", words(`and as assert async await break class continue def del
+		elif else except finally for from global if import in is lambda nonlocal
+		not or pass raise return try while with yield`)),
+	lexRuleFor("boolean", words(`True False`)),
+	lexRuleFor("constant", words(`None`)),
+	lexRuleFor("builtin", words(`abs all any bool bytes dict dir enumerate filter float
+		format getattr hasattr input int isinstance len list map max min next
+		object open print range repr reversed round set setattr sorted str sum
+		super tuple type zip`)),
+	lexRuleFor("function", `(`+identifierPattern+`)\(`),
+	lexRuleFor("", identifierPattern),
+	lexRuleFor("number", numberPattern+`j?\b`),
+	lexRuleFor("operator", operatorPattern+`|[~@]`),
+	lexRuleFor("punctuation", punctuationPattern),
+}
+
+var shellLexer = lexer{
+	lexRuleFor("", `\s+`),
+	lexRuleFor("comment", hashCommentPattern),
+	lexRuleFor("string", dqStringPattern+`|'[^']*'?`),
+	lexRuleFor("variable", `\$(?:\{[^}\n]*\}?|\w+|[@*#?$!-])`),
+	lexRuleFor("keyword", words(`if then else elif fi for while until do done case esac
+		function in select return export local readonly`)),
+	lexRuleFor("builtin", words(`alias bg cd echo eval exec exit fg jobs kill printf
+		pwd read set shift source test trap type ulimit umask unset wait`)),
+	lexRuleFor("", `[\w./-]+`),
+	lexRuleFor("operator", `&&|\|\||[|&;<>!=]`),
+	lexRuleFor("punctuation", `[{}()\[\]]`),
+}
+
+var jsonLexer = lexer{
+	lexRuleFor("", `\s+`),
+	lexRuleFor("property", `(`+dqStringPattern+`)\s*:`),
+	lexRuleFor("string", dqStringPattern),
+	lexRuleFor("number", `-?\d+(?:\.\d+)?(?:[eE][+-]?\d+)?`),
+	lexRuleFor("boolean", words(`true false`)),
+	lexRuleFor("null", words(`null`)),
+	lexRuleFor("punctuation", `[{}\[\],:]`),
+}
+
+var htmlLexer = lexer{
+	lexRuleFor("comment", `(?s:<!--.*?(?:-->|$))`),
+	lexRuleFor("doctype", `<![A-Za-z][^>\n]*>?`),
+	lexRuleFor("tag", `</?[A-Za-z][\w:-]*|/?>`),
+	lexRuleFor("attr-name", `([A-Za-z_:@][\w:.-]*)=`),
+	lexRuleFor("attr-value", `"[^"]*"?|'[^']*'?`),
+	lexRuleFor("entity", `&(?:#[xX][0-9a-fA-F]+|#\d+|\w+);`),
+	lexRuleFor("", `\s+|[^<&"'=\s]+`),
+}
@@ -0,0 +1,93 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"strings"
+	"testing"
+)
+
+var highlightCases = []struct {
+	lang, code, want string
+}{
+	{
+		"go",
+		"func f(s string) int { return len(s) + 0x1F } // f",
+		"[keyword func] [function f][punctuation (]s [builtin string][punctuation )] [builtin int] [punctuation {] " +
+			"[keyword return] [builtin len][punctuation (]s[punctuation )] [operator +] [number 0x1F] " +
+			"[punctuation }] [comment // f]",
+	},
+	{
+		"js",
+		"const x = `a${b}` /* c */ ?? null;",
+		"[keyword const] x [operator =] [string `a${b}`] [comment /* c */] [operator ??] " +
+			"[constant null][punctuation ;]",
+	},
+	{
+		"python",
+		"@cache\ndef f(x=None):\n    return 1.5j  # c",
+		"[decorator @cache]\n[keyword def] [function f][punctuation (]x[operator =][constant None][punctuation )][operator :]\n" +
+			"    [keyword return] [number 1.5j]  [comment # c]",
+	},
+	{
+		"sh",
+		"for f in *.go; do echo \"$f\" ${x}; done",
+		"[keyword for] f [keyword in] *.go[operator ;] [keyword do] [builtin echo] [string \"$f\"] " +
+			"[variable ${x}][operator ;] [keyword done]",
+	},
+	{
+		"json",
+		`{"a": [1, -2.5e3, true, null]}`,
+		`[punctuation {][property "a"][punctuation :] [punctuation [][number 1][punctuation ,] ` +
+			`[number -2.5e3][punctuation ,] [boolean true][punctuation ,] [null null][punctuation ]][punctuation }]`,
+	},
+	{
+		"html",
+		`<a href="x">T &amp; U</a><!-- c`,
+		`[tag <a] [attr-name href]=[attr-value "x"][tag >]T [entity &amp;] U[tag </a][tag >][comment <!-- c]`,
+	},
+	{
+		"go",
+		"s := \"unclosed\nx := 'a",
+		"s [operator :=] [string \"unclosed]\nx [operator :=] [char 'a]",
+	},
+}
+
+// highlighted writes the spans in tokens as [class text], for comparison.
+func highlighted(tokens []*html.Token) string {
+	var out strings.Builder
+	for _, tok := range tokens {
+		switch {
+		case tok.Type == html.TextToken:
+			out.WriteString(tok.Data)
+		case tok.Type == html.StartTagToken:
+			out.WriteString("[" + strings.TrimPrefix(tok.Attr[0].Val, "token ") + " ")
+		default:
+			out.WriteString("]")
+		}
+	}
+	return out.String()
+}
+
+func TestHighlighters(t *testing.T) {
+	highlighters := DefaultHighlighters()
+	for _, c := range highlightCases {
+		if got := highlighted(highlighters[c.lang].Highlight(c.code)); got != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.lang, got, c.want)
+		}
+	}
+}
+
+func TestHighlightOption(t *testing.T) {
+	upper := HighlighterFunc(func(code string) []*html.Token {
+		return []*html.Token{text(strings.ToUpper(code))}
+	})
+	opts := &Options{Highlighters: DefaultHighlighters()}
+	opts.Highlighters["shout"] = upper
+	input := "```go\nnil\n```\n\n```shout\nhi\n```\n\n```\nnil\n```"
+	want := "<pre><code class=\"go\"><span class=\"token constant\">nil</span></code></pre>\n" +
+		"<pre><code class=\"shout\">HI</code></pre>\n" +
+		"<pre><code>nil</code></pre>"
+	if got, _ := MarkdownWithOptions(input, opts); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
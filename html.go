@@ -3,6 +3,7 @@ package markdown
 import (
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
+	"strings"
 )
 
 var (
@@ -34,7 +35,16 @@ var (
 		H5: endH5,
 		H6: endH6,
 	}
+	listStartTag = map[TokenType]*html.Token{
+		ORDERED_LIST:   startOl,
+		UNORDERED_LIST: startUl,
+	}
+	listEndTag = map[TokenType]*html.Token{
+		ORDERED_LIST:   endOl,
+		UNORDERED_LIST: endUl,
+	}
 	endA        = &html.Token{Type: html.EndTagToken, DataAtom: atom.A, Data: "a"}
+	br          = &html.Token{Type: html.StartTagToken, DataAtom: atom.Br, Data: "br"}
 	startCode   = &html.Token{Type: html.StartTagToken, DataAtom: atom.Code, Data: "code"}
 	endCode     = &html.Token{Type: html.EndTagToken, DataAtom: atom.Code, Data: "code"}
 	startPre    = &html.Token{Type: html.StartTagToken, DataAtom: atom.Pre, Data: "pre"}
@@ -65,6 +75,28 @@ var (
 		Attr: []html.Attribute{{Key: "style", Val: "text-align: center;"}}}
 	startTdR = &html.Token{Type: html.StartTagToken, DataAtom: atom.Td, Data: "td",
 		Attr: []html.Attribute{{Key: "style", Val: "text-align: right;"}}}
+	startBlockquote = &html.Token{Type: html.StartTagToken, DataAtom: atom.Blockquote, Data: "blockquote"}
+	endBlockquote   = &html.Token{Type: html.EndTagToken, DataAtom: atom.Blockquote, Data: "blockquote"}
+	startMathInline = &html.Token{Type: html.StartTagToken, DataAtom: atom.Span, Data: "span",
+		Attr: []html.Attribute{{Key: "class", Val: "math inline"}}}
+	startMathDisplay = &html.Token{Type: html.StartTagToken, DataAtom: atom.Div, Data: "div",
+		Attr: []html.Attribute{{Key: "class", Val: "math display"}}}
+	startEquationNumber = &html.Token{Type: html.StartTagToken, DataAtom: atom.Span, Data: "span",
+		Attr: []html.Attribute{{Key: "class", Val: "equation-number"}}}
+	endSpan         = &html.Token{Type: html.EndTagToken, DataAtom: atom.Span, Data: "span"}
+	startLineNumber = &html.Token{Type: html.StartTagToken, DataAtom: atom.Span, Data: "span",
+		Attr: []html.Attribute{{Key: "class", Val: "line-number"}}}
+	startCodeFigure = &html.Token{Type: html.StartTagToken, DataAtom: atom.Figure, Data: "figure",
+		Attr: []html.Attribute{{Key: "class", Val: "code-block"}}}
+	endFigure            = &html.Token{Type: html.EndTagToken, DataAtom: atom.Figure, Data: "figure"}
+	startFigcaption      = &html.Token{Type: html.StartTagToken, DataAtom: atom.Figcaption, Data: "figcaption"}
+	endFigcaption        = &html.Token{Type: html.EndTagToken, DataAtom: atom.Figcaption, Data: "figcaption"}
+	startSummary         = &html.Token{Type: html.StartTagToken, DataAtom: atom.Summary, Data: "summary"}
+	endSummary           = &html.Token{Type: html.EndTagToken, DataAtom: atom.Summary, Data: "summary"}
+	endDetails           = &html.Token{Type: html.EndTagToken, DataAtom: atom.Details, Data: "details"}
+	endDiv               = &html.Token{Type: html.EndTagToken, DataAtom: atom.Div, Data: "div"}
+	startAdmonitionTitle = &html.Token{Type: html.StartTagToken, DataAtom: atom.P, Data: "p",
+		Attr: []html.Attribute{{Key: "class", Val: "admonition-title"}}}
 )
 
 func text(s string) *html.Token {
@@ -73,20 +105,24 @@ func text(s string) *html.Token {
 
 var (
 	blockTag = map[atom.Atom]bool{
-		atom.H1:    true,
-		atom.H2:    true,
-		atom.H3:    true,
-		atom.H4:    true,
-		atom.H5:    true,
-		atom.H6:    true,
-		atom.P:     true,
-		atom.Div:   true,
-		atom.Pre:   true,
-		atom.Ol:    true,
-		atom.Ul:    true,
-		atom.Li:    true,
-		atom.Table: true,
-		atom.Tr:    true,
+		atom.H1:         true,
+		atom.H2:         true,
+		atom.H3:         true,
+		atom.H4:         true,
+		atom.H5:         true,
+		atom.H6:         true,
+		atom.P:          true,
+		atom.Div:        true,
+		atom.Pre:        true,
+		atom.Figure:     true,
+		atom.Ol:         true,
+		atom.Ul:         true,
+		atom.Li:         true,
+		atom.Table:      true,
+		atom.Tr:         true,
+		atom.Blockquote: true,
+		atom.Details:    true,
+		atom.Summary:    true,
 	}
 	inlineTag = map[atom.Atom]bool{
 		atom.B:        true,
@@ -121,18 +157,78 @@ var (
 		atom.Textarea: true,
 	}
 	inlineBlock = map[atom.Atom]bool{
-		atom.H1:  true,
-		atom.H2:  true,
-		atom.H3:  true,
-		atom.H4:  true,
-		atom.H5:  true,
-		atom.H6:  true,
-		atom.P:   true,
-		atom.Pre: true,
-		atom.Li:  true,
-		atom.Td:  true,
-		atom.Dt:  true,
-		atom.Dd:  true,
+		atom.H1:      true,
+		atom.H2:      true,
+		atom.H3:      true,
+		atom.H4:      true,
+		atom.H5:      true,
+		atom.H6:      true,
+		atom.P:       true,
+		atom.Pre:     true,
+		atom.Li:      true,
+		atom.Td:      true,
+		atom.Dt:      true,
+		atom.Dd:      true,
+		atom.Summary: true,
+	}
+	// phrasingTag is the set of block elements that can only contain inline
+	// content, so can't contain paragraphs.
+	phrasingTag = map[atom.Atom]bool{
+		atom.H1:      true,
+		atom.H2:      true,
+		atom.H3:      true,
+		atom.H4:      true,
+		atom.H5:      true,
+		atom.H6:      true,
+		atom.P:       true,
+		atom.Pre:     true,
+		atom.Summary: true,
+	}
+	// voidElement is the set of elements that have no end tag.
+	voidElement = map[atom.Atom]bool{
+		atom.Area:   true,
+		atom.Base:   true,
+		atom.Br:     true,
+		atom.Col:    true,
+		atom.Embed:  true,
+		atom.Hr:     true,
+		atom.Img:    true,
+		atom.Input:  true,
+		atom.Link:   true,
+		atom.Meta:   true,
+		atom.Param:  true,
+		atom.Source: true,
+		atom.Track:  true,
+		atom.Wbr:    true,
+	}
+	// rawText is the set of elements whose text isn't escaped.
+	rawText = map[atom.Atom]bool{
+		atom.Script: true,
+		atom.Style:  true,
+	}
+	// mathTag is the set of MathML elements, most of which have no atom.
+	mathTag = map[string]bool{
+		"math":       true,
+		"semantics":  true,
+		"annotation": true,
+		"mrow":       true,
+		"mi":         true,
+		"mn":         true,
+		"mo":         true,
+		"mtext":      true,
+		"mspace":     true,
+		"mfrac":      true,
+		"msqrt":      true,
+		"mroot":      true,
+		"msub":       true,
+		"msup":       true,
+		"msubsup":    true,
+		"munder":     true,
+		"mover":      true,
+		"munderover": true,
+		"mtable":     true,
+		"mtr":        true,
+		"mtd":        true,
 	}
 )
 
@@ -143,5 +239,16 @@ func inline(token *html.Token) bool {
 	if token.Type == html.TextToken {
 		return true
 	}
-	return inlineTag[token.DataAtom]
+	return inlineTag[token.DataAtom] || mathTag[token.Data]
+}
+
+// htmlTokens returns the tokens of the HTML in s.
+func htmlTokens(s string) []*html.Token {
+	var tokens []*html.Token
+	tt := html.NewTokenizer(strings.NewReader(s))
+	for tt.Next() != html.ErrorToken {
+		tok := tt.Token()
+		tokens = append(tokens, &tok)
+	}
+	return tokens
 }
@@ -0,0 +1,87 @@
+package markdown
+
+import (
+	"fmt"
+	"golang.org/x/net/html"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth is how deeply includes may be nested.
+const maxIncludeDepth = 16
+
+// resolvePath returns the path in Options.FS of a file named in a directive.
+// A relative path is relative to the file the directive is in, and an
+// absolute path is relative to the root of Options.FS.
+func (p *Parser) resolvePath(name string) (string, error) {
+	if p.opts.FS == nil {
+		return "", fmt.Errorf("can't read %s: no Options.FS", name)
+	}
+	resolved := strings.TrimPrefix(name, "/")
+	if !strings.HasPrefix(name, "/") {
+		resolved = path.Join(path.Dir(p.file), name)
+	}
+	if !fs.ValidPath(resolved) {
+		return "", fmt.Errorf("can't read %s: outside Options.FS", name)
+	}
+	return resolved, nil
+}
+
+// parseIncludeDirective parses an include directive, which parses a file in
+// Options.FS as Markdown in its place, as in
+// <!--include src="snippets/intro.md"-->. An offset attribute moves its
+// headers down that many levels, as in offset="1", or up if it's negative.
+func (p *Parser) parseIncludeDirective(attrs []html.Attribute) {
+	var src string
+	offset := 0
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "src":
+			src = attr.Val
+		case "offset":
+			n, err := strconv.Atoi(attr.Val)
+			if err != nil {
+				p.warnf(p.pos-1, "bad offset %q", attr.Val)
+				return
+			}
+			offset = n
+		}
+	}
+	if src == "" {
+		p.warnf(p.pos-1, "include directive has no src")
+		return
+	}
+	file, err := p.resolvePath(src)
+	if err != nil {
+		p.warnf(p.pos-1, "%v", err)
+		return
+	}
+	chain := append(append([]string(nil), p.includes...), p.file)
+	for _, include := range chain {
+		if include == file {
+			p.warnf(p.pos-1, "include cycle: %s", strings.Join(append(chain[1:], file), " -> "))
+			return
+		}
+	}
+	if len(p.includes) >= maxIncludeDepth {
+		p.warnf(p.pos-1, "can't include %s: includes are nested more than %d deep", src, maxIncludeDepth)
+		return
+	}
+	buf, err := fs.ReadFile(p.opts.FS, file)
+	if err != nil {
+		p.warnf(p.pos-1, "can't read %s: %v", src, err)
+		return
+	}
+	child := p.child(nil)
+	if child == nil {
+		return
+	}
+	child.file = file
+	child.includes = chain
+	child.headerOffset += offset
+	child.parse(NewScanner(string(buf)))
+	p.block()
+	p.tokens = append(p.tokens, child.tokens...)
+}
@@ -0,0 +1,76 @@
+package markdown
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+var includeFS = fstest.MapFS{
+	"page.md":             {Data: []byte("# Page\n\n<!--include src=\"snippets/intro.md\" offset=\"1\"-->\n\nEnd")},
+	"snippets/intro.md":   {Data: []byte("# Intro\n\nSee [x] here\n\n<!--include src=\"note.md\"-->")},
+	"snippets/note.md":    {Data: []byte("*Note* <!--code src=\"/run.sh\"-->")},
+	"run.sh":              {Data: []byte("echo hi\n")},
+	"loop/a.md":           {Data: []byte("A\n\n<!--include src=\"b.md\"-->")},
+	"loop/b.md":           {Data: []byte("B\n\n<!--include src=\"a.md\"-->")},
+	"snippets/missing.md": {Data: []byte("<!--include src=\"../../x.md\"--><!--include src=\"gone.md\"-->")},
+}
+
+func TestIncludeDirective(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for name, file := range includeFS {
+		fsys[name] = file
+	}
+	for i := 0; i < 20; i++ {
+		fsys[fmt.Sprintf("deep/%d.md", i)] = &fstest.MapFile{
+			Data: []byte(fmt.Sprintf("%d <!--include src=\"%d.md\"-->", i, i+1)),
+		}
+	}
+	cases := []struct {
+		input, want string
+		diags       []string
+	}{
+		{
+			"<!--include src=\"page.md\"-->",
+			"<h1>Page</h1>\n<h2>Intro</h2>\n<p>See [x] here</p>\n" +
+				"<p><em>Note</em> </p>\n<pre><code class=\"sh\">echo hi</code></pre>\n<p>End</p>",
+			[]string{"snippets/intro.md:3:5: [x] has no (href)"},
+		},
+		{
+			"<!--include src=\"loop/a.md\"-->",
+			"<p>A</p>\n<p>B</p>",
+			[]string{"loop/b.md:3:1: include cycle: loop/a.md -> loop/b.md -> loop/a.md"},
+		},
+		{
+			"<!--include src=\"snippets/missing.md\"-->",
+			"",
+			[]string{
+				"snippets/missing.md:1:1: can't read ../../x.md: outside Options.FS",
+				"snippets/missing.md:1:32: can't read gone.md: open snippets/gone.md: file does not exist",
+			},
+		},
+		{
+			"<!--include src=\"deep/0.md\"-->",
+			"<p>0 </p>\n<p>1 </p>\n<p>2 </p>\n<p>3 </p>\n<p>4 </p>\n<p>5 </p>\n<p>6 </p>\n<p>7 </p>\n" +
+				"<p>8 </p>\n<p>9 </p>\n<p>10 </p>\n<p>11 </p>\n<p>12 </p>\n<p>13 </p>\n<p>14 </p>\n<p>15 </p>",
+			[]string{"deep/15.md:1:4: can't include 16.md: includes are nested more than 16 deep"},
+		},
+	}
+	for _, c := range cases {
+		got, diags, err := MarkdownE(c.input, &Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("got\n%s\nwant\n%s", got, c.want)
+		}
+		var msgs []string
+		for _, d := range diags {
+			msgs = append(msgs, d.String())
+		}
+		if !reflect.DeepEqual(msgs, c.diags) {
+			t.Errorf("%q: got diagnostics %q, want %q", c.input, msgs, c.diags)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package markdown
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A delimiter is a run of * or _ characters that may open or close emphasis.
+type delimiter struct {
+	pos, n, length    int
+	char              byte
+	canOpen, canClose bool
+}
+
+// A bracket is the opening [ of a link or ![ of an image. bottom is the
+// number of delimiters on the stack when it was opened.
+type bracket struct {
+	pos, bottom int
+	image       bool
+	active      bool
+}
+
+// matchSpan matches the emphasis, link, image, code, HTML or math span
+// starting at the current position, if there is one.
+func (s *Scanner) matchSpan(str string) *Token {
+	if s.pos >= s.runEnd {
+		s.scanRun()
+	}
+	tok := s.spans[s.pos]
+	if tok != nil && (tok.Type == EM || tok.Type == STRONG) {
+		// Emphasis is joined onto one line here rather than when it's found,
+		// since spans nested inside others are never matched.
+		tok.Lit = strings.Replace(tok.Lit, "\n", " ", -1)
+	}
+	return tok
+}
+
+// scanRun finds the spans in the run of inline text starting at the current
+// position. A run continues until a blank line or a line that starts a block,
+// except that a header's run ends with its line.
+func (s *Scanner) scanRun() {
+	start := strings.LastIndexByte(s.src[:s.pos], '\n') + 1
+	end := lineEnd(s.src, s.pos)
+	header := headerRe.MatchString(s.src[start:end])
+	for end < len(s.src) && !header {
+		next := lineEnd(s.src, end+1)
+		line := s.src[end+1 : next]
+		if strings.TrimSpace(line) == "" || blockStart.MatchString(line) {
+			break
+		}
+		end = next
+	}
+	s.runEnd = end
+	s.spans = make(map[int]*Token)
+	s.delims = s.delims[:0]
+	lastTicks := backtickRuns(s.src[:end], s.pos)
+	var brackets []*bracket
+	// The next > and math delimiters, and the closing parentheses on the
+	// line of the last link destination, are remembered so that each is only
+	// searched for once.
+	nextGT, parensEnd := -1, -1
+	var parens map[int]int
+	mathEnd := make(map[string]int)
+	nextMathEnd := func(from int, delim string) int {
+		if j, ok := mathEnd[delim]; !ok || j < from {
+			mathEnd[delim] = nextString(s.src[:end], from, delim)
+		}
+		return mathEnd[delim]
+	}
+	dollarEnd := -1
+	for i := s.pos; i < end; i++ {
+		switch c := s.src[i]; c {
+		case '\\':
+			if i+1 < end && (s.src[i+1] == '(' || s.src[i+1] == '[') {
+				typ, delim := TokenType(MATHML), `\)`
+				if s.src[i+1] == '[' {
+					typ, delim = MATH_BLOCK, `\]`
+				}
+				if j := nextMathEnd(i+2, delim); j < end {
+					s.addSpan(typ, i, j+2, strings.TrimSpace(s.src[i+2:j]))
+					i = j + 1
+					break
+				}
+			}
+			if i+1 < end && isASCIIPunct(s.src[i+1]) {
+				i++
+			}
+		case '`':
+			n := backtickRun(s.src[:end], i)
+			if lastTicks[n] <= i {
+				// Without a closing run the backticks are literal.
+				i += n - 1
+				break
+			}
+			// The span closes at the next run of exactly n backticks.
+			j := i + n
+			for {
+				j += strings.IndexByte(s.src[j:end], '`')
+				m := backtickRun(s.src[:end], j)
+				if m == n {
+					break
+				}
+				j += m
+			}
+			s.addSpan(CODE, i, j+n, codeSpan(s.src[i+n:j]))
+			i = j + n - 1
+		case '<':
+			// Nothing inside raw HTML is a span, or a delimiter of one.
+			if n := max(rawDirectiveEnd(s.src[i:]), s.rawElementEnd(s.src[i:])); n > 0 {
+				i = min(i+n, end) - 1
+				break
+			}
+			if nextGT <= i {
+				nextGT = nextByte(s.src[:end], i+1, '>')
+			}
+			if nextGT < end {
+				s.spans[i] = &Token{HTML_TAG, s.src[i : nextGT+1], s.src[i : nextGT+1]}
+				i = nextGT
+			}
+		case '$':
+			if i+1 < end && s.src[i+1] == '$' {
+				if j := nextMathEnd(i+2, "$$"); j < end {
+					s.addSpan(MATH_BLOCK, i, j+2, strings.TrimSpace(s.src[i+2:j]))
+					i = j + 1
+				} else {
+					i++
+				}
+				break
+			}
+			// As in pandoc, inline math can't start with a space, so that
+			// amounts like $5 and $10 aren't math.
+			if i+1 >= end || strings.IndexByte(" \t\n", s.src[i+1]) >= 0 {
+				break
+			}
+			if dollarEnd <= i {
+				dollarEnd = closingDollar(s.src[:end], i+1)
+			}
+			if dollarEnd < end {
+				s.addSpan(MATHML, i, dollarEnd+1, strings.Replace(s.src[i+1:dollarEnd], "\n", " ", -1))
+				i = dollarEnd
+			}
+		case '!':
+			if i+1 < end && s.src[i+1] == '[' {
+				brackets = append(brackets, &bracket{pos: i, bottom: len(s.delims), image: true, active: true})
+				i++
+			}
+		case '[':
+			brackets = append(brackets, &bracket{pos: i, bottom: len(s.delims), active: true})
+		case ']':
+			if len(brackets) == 0 {
+				break
+			}
+			b := brackets[len(brackets)-1]
+			brackets = brackets[:len(brackets)-1]
+			if !b.active {
+				break
+			}
+			s.processEmphasis(s.delims[b.bottom:])
+			s.delims = s.delims[:b.bottom]
+			if b.image {
+				s.spans[b.pos] = &Token{IMG_ALT, s.src[b.pos+2 : i], s.src[b.pos : i+1]}
+			} else {
+				s.spans[b.pos] = &Token{LINK_TEXT, s.src[b.pos+1 : i], s.src[b.pos : i+1]}
+			}
+			if i+1 >= end || s.src[i+1] != '(' {
+				break
+			}
+			if i+1 > parensEnd {
+				parens, parensEnd = closingParens(s.src[:end], i+1), lineEnd(s.src[:end], i+1)
+			}
+			j, ok := parens[i+1]
+			if !ok {
+				break
+			}
+			s.spans[i+1] = &Token{HREF, unescape(s.src[i+2 : j]), s.src[i+1 : j+1]}
+			i = j
+			if b.image {
+				break
+			}
+			// Links may not contain other links.
+			for k := len(brackets) - 1; k >= 0 && brackets[k].active; k-- {
+				if !brackets[k].image {
+					brackets[k].active = false
+				}
+			}
+		case '*', '_':
+			n := 1
+			for i+n < end && s.src[i+n] == c {
+				n++
+			}
+			s.delims = append(s.delims, s.newDelimiter(i, n))
+			i += n - 1
+		}
+	}
+	s.processEmphasis(s.delims)
+}
+
+// nextByte returns the index of the first c in s at or after pos, or len(s).
+func nextByte(s string, pos int, c byte) int {
+	if i := strings.IndexByte(s[pos:], c); i >= 0 {
+		return pos + i
+	}
+	return len(s)
+}
+
+// nextString returns the index of the first sub in s at or after pos, or
+// len(s).
+func nextString(s string, pos int, sub string) int {
+	if i := strings.Index(s[pos:], sub); i >= 0 {
+		return pos + i
+	}
+	return len(s)
+}
+
+// closingDollar returns the index of the first $ after pos that can close
+// inline math, or len(s). As in pandoc, it can't follow a space or be
+// followed by a digit, and a $ can be escaped with a backslash.
+func closingDollar(s string, pos int) int {
+	for i := pos; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == '$' && strings.IndexByte(" \t\n", s[i-1]) < 0 &&
+			!(i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9') {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// closingParens returns the index of the ) matching each unescaped ( on the
+// line of s from pos, so that a link destination, which ends at the )
+// matching the ( it starts after, may contain balanced parentheses, as in
+// [a](f(x)).
+func closingParens(s string, pos int) map[int]int {
+	closing := make(map[int]int)
+	var open []int
+	for i := pos; i < len(s) && s[i] != '\n'; i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && isASCIIPunct(s[i+1]) {
+				i++
+			}
+		case '(':
+			open = append(open, i)
+		case ')':
+			if len(open) > 0 {
+				closing[open[len(open)-1]] = i
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	return closing
+}
+
+// backtickRuns returns the start of the last run of backticks of each length
+// in s after pos.
+func backtickRuns(s string, pos int) map[int]int {
+	runs := make(map[int]int)
+	for i := pos; i < len(s); i++ {
+		if s[i] == '`' {
+			n := backtickRun(s, i)
+			runs[n] = i
+			i += n - 1
+		}
+	}
+	return runs
+}
+
+// backtickRun returns the length of the run of backticks at pos.
+func backtickRun(s string, pos int) int {
+	n := 0
+	for pos+n < len(s) && s[pos+n] == '`' {
+		n++
+	}
+	return n
+}
+
+// codeSpan returns the content of a code span, with a single space stripped
+// from each end if it both begins and ends with a space, so that a span can
+// begin or end with a backtick.
+func codeSpan(code string) string {
+	code = strings.Replace(code, "\n", " ", -1)
+	if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+		code = code[1 : len(code)-1]
+	}
+	return code
+}
+
+func (s *Scanner) addSpan(typ TokenType, start, end int, lit string) {
+	s.spans[start] = &Token{typ, lit, s.src[start:end]}
+}
+
+// newDelimiter returns the delimiter for the run of n characters at pos,
+// following CommonMark's rules for left- and right-flanking delimiter runs.
+// A _ run inside a word can't open or close emphasis, so that identifiers
+// like snake_case_name are left alone.
+func (s *Scanner) newDelimiter(pos, n int) *delimiter {
+	before, after := ' ', ' '
+	if pos > 0 {
+		before, _ = utf8.DecodeLastRuneInString(s.src[:pos])
+	}
+	if pos+n < len(s.src) {
+		after, _ = utf8.DecodeRuneInString(s.src[pos+n:])
+	}
+	left := !unicode.IsSpace(after) &&
+		(!isPunct(after) || unicode.IsSpace(before) || isPunct(before))
+	right := !unicode.IsSpace(before) &&
+		(!isPunct(before) || unicode.IsSpace(after) || isPunct(after))
+	d := &delimiter{
+		pos:      pos,
+		n:        n,
+		length:   n,
+		char:     s.src[pos],
+		canOpen:  left,
+		canClose: right,
+	}
+	if d.char == '_' {
+		d.canOpen = left && (!right || isPunct(before))
+		d.canClose = right && (!left || isPunct(after))
+	}
+	return d
+}
+
+// processEmphasis pairs up the openers and closers in delims, innermost
+// first, adding an EM or STRONG span for each pair.
+func (s *Scanner) processEmphasis(delims []*delimiter) {
+	n := len(delims)
+	prev, next := make([]int, n), make([]int, n)
+	for i := range delims {
+		prev[i], next[i] = i-1, i+1
+	}
+	remove := func(i int) {
+		if prev[i] >= 0 {
+			next[prev[i]] = next[i]
+		}
+		if next[i] < n {
+			prev[next[i]] = prev[i]
+		}
+	}
+	// openersBottom[char][closer length % 3][closer can open] is the
+	// delimiter below which no opener was found for such a closer.
+	var openersBottom [2][3][2]int
+	for i := range openersBottom {
+		for j := range openersBottom[i] {
+			openersBottom[i][j] = [2]int{-1, -1}
+		}
+	}
+	for c := 0; c < n; {
+		closer := delims[c]
+		if !closer.canClose {
+			c = next[c]
+			continue
+		}
+		bottom := &openersBottom[strings.IndexByte("*_", closer.char)][closer.length%3][boolIndex(closer.canOpen)]
+		o := prev[c]
+		for ; o > *bottom; o = prev[o] {
+			opener := delims[o]
+			if opener.char != closer.char || !opener.canOpen {
+				continue
+			}
+			if (opener.canClose || closer.canOpen) &&
+				(opener.length+closer.length)%3 == 0 &&
+				!(opener.length%3 == 0 && closer.length%3 == 0) {
+				continue
+			}
+			break
+		}
+		if o <= *bottom {
+			*bottom = prev[c]
+			if !closer.canOpen {
+				remove(c)
+			}
+			c = next[c]
+			continue
+		}
+		opener := delims[o]
+		use := 1
+		if opener.n >= 2 && closer.n >= 2 {
+			use = 2
+		}
+		start := opener.pos + opener.n - use
+		var typ TokenType = EM
+		if use == 2 {
+			typ = STRONG
+		}
+		s.addSpan(typ, start, closer.pos+use, s.src[start+use:closer.pos])
+		for i := next[o]; i != c; i = next[i] {
+			remove(i)
+		}
+		opener.n -= use
+		closer.pos += use
+		closer.n -= use
+		if opener.n == 0 {
+			remove(o)
+		}
+		if closer.n == 0 {
+			remove(c)
+			c = next[c]
+		}
+	}
+}
+
+func boolIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// isPunct reports whether r is Unicode punctuation, which CommonMark takes to
+// include symbols.
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
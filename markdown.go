@@ -1,5 +1,85 @@
 package markdown
 
+import (
+	"fmt"
+	"golang.org/x/net/html"
+	"io/fs"
+)
+
+// Options configures the parser.
+type Options struct {
+	// HardWraps renders every newline inside a paragraph as a line break, as
+	// GitHub does for comments.
+	HardWraps bool
+	// Policy, if set, removes the HTML it doesn't allow from the output.
+	Policy *Policy
+	// MaxInputSize, MaxDepth and MaxTokens limit the size of the input in
+	// bytes, how deeply blocks and spans may be nested and the number of
+	// tokens scanned, including those of nested content. Parsing fails with
+	// an ErrLimit when one is exceeded. Zero means no limit, except that
+	// with a zero MaxDepth, content nested more than 32 deep is left as
+	// text, with a diagnostic: nested content is parsed again at each level,
+	// so the time taken grows with the depth. A negative MaxDepth means no
+	// limit, for trusted input.
+	MaxInputSize, MaxDepth, MaxTokens int
+	// InlineMath and DisplayMath are the start tags of the elements math is
+	// wrapped in. They default to <span class="math inline"> and
+	// <div class="math display">, where MathJax and KaTeX can find it.
+	InlineMath, DisplayMath *html.Token
+	// MathML converts math to MathML inside those elements, so that it
+	// renders without scripts. Only a common subset of TeX is supported:
+	// math that uses anything else is left as TeX, with a diagnostic.
+	MathML bool
+	// EquationSection numbers labelled equations within sections, which
+	// start at each header of that level, rather than through the whole
+	// document.
+	EquationSection int
+	// EquationNumber formats the number shown beside the nth labelled
+	// equation and in references to it. section is zero unless
+	// EquationSection is set. It defaults to "(n)", or "(section.n)".
+	EquationNumber func(section, n int) string
+	// Highlighters highlights the code in fenced code blocks, using the
+	// highlighter for the language named after the opening fence. Set it to
+	// DefaultHighlighters() to use the built-in ones, and add to or replace
+	// them to highlight other languages.
+	Highlighters map[string]Highlighter
+	// CodeRenderers renders the fenced code blocks of their languages as the
+	// HTML they return, instead of as pre elements. If a renderer returns an
+	// error, the block is rendered as usual, with a diagnostic.
+	CodeRenderers map[string]CodeRenderer
+	// Admonitions renders the admonitions of their types, such as
+	// ":::warning" containers, instead of DefaultAdmonition.
+	Admonitions map[string]AdmonitionRenderer
+	// FS is where the files named by directives, such as
+	// <!--code src="main.go"-->, are read from. Directives in the input can
+	// read any file in it, so when the input is untrusted, it should only
+	// hold files that may be shown.
+	FS fs.FS
+}
+
 func Markdown(input string) string {
 	return PrettyPrint(Parse(input))
 }
+
+func MarkdownWithOptions(input string, opts *Options) (string, error) {
+	tokens, err := ParseWithOptions(input, opts)
+	if err != nil {
+		return "", err
+	}
+	return PrettyPrint(tokens), nil
+}
+
+// MarkdownE is like MarkdownWithOptions, but also returns diagnostics for the
+// problems in the input the parser recovered from, and never panics.
+func MarkdownE(input string, opts *Options) (out string, diags []Diagnostic, err error) {
+	tokens, diags, err := ParseE(input, opts)
+	if err != nil {
+		return "", diags, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = "", fmt.Errorf("markdown: internal error: %v", r)
+		}
+	}()
+	return PrettyPrint(tokens), diags, nil
+}
@@ -1,9 +1,13 @@
 package markdown
 
 import (
+	"bytes"
 	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 	"io/ioutil"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -53,12 +57,202 @@ var testCases = []testCase{
 	},
 	{
 		"$Multiline\nmathml$",
-		"<p>$Multiline mathml$</p>",
+		"<p><span class=\"math inline\">\\(Multiline mathml\\)</span></p>",
 	},
 	{
 		"*Multiline\nemphasis*",
 		"<p><em>Multiline emphasis</em></p>",
 	},
+	{
+		"* A\n  1. B\n  2. C\n* D",
+		"<ul>\n\t<li>A\n\t\t<ol>\n\t\t\t<li>B</li>\n\t\t\t<li>C</li>\n\t\t</ol>\n\t</li>\n\t<li>D</li>\n</ul>",
+	},
+	{
+		"1. A\n   - B\n     1. C\n2. D",
+		"<ol>\n\t<li>A\n\t\t<ul>\n\t\t\t<li>B\n\t\t\t\t<ol>\n\t\t\t\t\t<li>C</li>\n\t\t\t\t</ol>\n\t\t\t</li>\n\t\t</ul>\n\t</li>\n\t<li>D</li>\n</ol>",
+	},
+	{
+		"Some text\n* A\n* B",
+		"<p>Some text</p>\n<ul>\n\t<li>A</li>\n\t<li>B</li>\n</ul>",
+	},
+	{
+		"1. A\n\n   More A\n\n   ```go\n   x := 1\n   ```\n2. B",
+		"<ol>\n\t<li>\n\t\t<p>A</p>\n\t\t<p>More A</p>\n\t\t<pre><code class=\"go\">x := 1</code></pre>\n\t</li>\n\t<li>\n\t\t<p>B</p>\n\t</li>\n</ol>",
+	},
+	{
+		"* A\n  > Quoted\n* B\n\nAfter",
+		"<ul>\n\t<li>A\n\t\t<blockquote>\n\t\t\t<p>Quoted</p>\n\t\t</blockquote>\n\t</li>\n\t<li>B</li>\n</ul>\n<p>After</p>",
+	},
+	{
+		"* A\n\n  x | y\n  --|--\n  1 | 2",
+		"<ul>\n\t<li>\n\t\t<p>A</p>\n\t\t<table>\n\t\t\t<tr>\n\t\t\t\t<th>x</th>\n\t\t\t\t<th>y</th>\n\t\t\t</tr>\n\t\t\t<tr>\n\t\t\t\t<td>1</td>\n\t\t\t\t<td>2</td>\n\t\t\t</tr>\n\t\t</table>\n\t</li>\n</ul>",
+	},
+	{
+		"> A quote\n> * with a list",
+		"<blockquote>\n\t<p>A quote</p>\n\t<ul>\n\t\t<li>with a list</li>\n\t</ul>\n</blockquote>",
+	},
+	{
+		"3. Three\n4. Four",
+		"<ol start=\"3\">\n\t<li>Three</li>\n\t<li>Four</li>\n</ol>",
+	},
+	{
+		"1) One\n2) Two\n3. Three",
+		"<ol>\n\t<li>One</li>\n\t<li>Two</li>\n</ol>\n<ol start=\"3\">\n\t<li>Three</li>\n</ol>",
+	},
+	{
+		"+ One\n+ Two\n- Three",
+		"<ul>\n\t<li>One</li>\n\t<li>Two</li>\n</ul>\n<ul>\n\t<li>Three</li>\n</ul>",
+	},
+	{
+		"The year was\n1984. It was cold.",
+		"<p>The year was\n1984. It was cold.</p>",
+	},
+	{
+		"*see [the docs](www.example.com)*",
+		"<p><em>see <a href=\"www.example.com\">the docs</a></em></p>",
+	},
+	{
+		"**bold with `code`**",
+		"<p><strong>bold with <code>code</code></strong></p>",
+	},
+	{
+		"[*emph* link](www.example.com)",
+		"<p><a href=\"www.example.com\"><em>emph</em> link</a></p>",
+	},
+	{
+		"[![An img](img.png)](www.example.com)",
+		"<p><a href=\"www.example.com\"><img alt=\"An img\" src=\"img.png\"/></a></p>",
+	},
+	{
+		"***strong emphasis*** and *a **nested** b*",
+		"<p><em><strong>strong emphasis</strong></em> and <em>a <strong>nested</strong> b</em></p>",
+	},
+	{
+		"[a [b](www.example.com) c](d)",
+		"<p>[a <a href=\"www.example.com\">b</a> c](d)</p>",
+	},
+	{
+		"snake_case_name and _emphasis_",
+		"<p>snake_case_name and <em>emphasis</em></p>",
+	},
+	{
+		"a * b * c and a*b*c",
+		"<p>a * b * c and a<em>b</em>c</p>",
+	},
+	{
+		"straße_mit_ and a*„quote“* and *„quote“*",
+		"<p>straße_mit_ and a*„quote“* and <em>„quote“</em></p>",
+	},
+	{
+		"日本*語*です",
+		"<p>日本<em>語</em>です</p>",
+	},
+	{
+		"`` a ` b `` and ` `` `",
+		"<p><code>a ` b</code> and <code>``</code></p>",
+	},
+	{
+		"`foo\\`bar`",
+		"<p><code>foo\\</code>bar`</p>",
+	},
+	{
+		"\\``code`",
+		"<p>`<code>code</code></p>",
+	},
+	{
+		"```inline``` and ``unclosed",
+		"<p><code>inline</code> and ``unclosed</p>",
+	},
+	{
+		"`*not em* [not link](x)`",
+		"<p><code>*not em* [not link](x)</code></p>",
+	},
+	{
+		"C:\\\\path and \\d+ and \\*not em\\*",
+		"<p>C:\\path and \\d+ and *not em*</p>",
+	},
+	{
+		"&copy; &#35; &amp; &foo; AT&T \\&copy;",
+		"<p>© # &amp; &amp;foo; AT&amp;T &amp;copy;</p>",
+	},
+	{
+		"`&copy; \\*` [a](x\\)y&amp;z)",
+		"<p><code>&amp;copy; \\*</code> <a href=\"x)y&amp;z\">a</a></p>",
+	},
+	{
+		"[a](f(x)) and [b](g(h(1))\\(2) [c]((x) [d](y)",
+		"<p><a href=\"f(x)\">a</a> and <a href=\"g(h(1))(2\">b</a> [c]((x) <a href=\"y\">d</a></p>",
+	},
+	{
+		"a\\|b | c\n--|--\n1 | 2",
+		"<table>\n\t<tr>\n\t\t<th>a|b</th>\n\t\t<th>c</th>\n\t</tr>\n\t<tr>\n\t\t<td>1</td>\n\t\t<td>2</td>\n\t</tr>\n</table>",
+	},
+	{
+		"Roses are red  \nViolets\\\nblue\\\\\n*em*  \nend \\",
+		"<p>Roses are red<br>\nViolets<br>\nblue\\\n<em>em</em><br>\nend \\</p>",
+	},
+	{
+		"# a | b\n\n####### seven",
+		"<h1>a | b</h1>\n<p>####### seven</p>",
+	},
+	{
+		"It costs $5 and $10, or $20,000.\n\nNot \\$x$ or $a$5.\n\n$F = ma$",
+		"<p>It costs $5 and $10, or $20,000.</p>\n<p>Not $x$ or $a$5.</p>\n<p><span class=\"math inline\">\\(F = ma\\)</span></p>",
+	},
+	{
+		"Inline \\(x^2\\), display $$\\int f$$ and \\[ y < 1 \\] in a paragraph.",
+		"<p>Inline <span class=\"math inline\">\\(x^2\\)</span>, display <span class=\"math display\">\\[\\int f\\]</span> and <span class=\"math display\">\\[y &lt; 1\\]</span> in a paragraph.</p>",
+	},
+	{
+		"- item $$y$$\n\nSee\n$$E=mc^2$$\n\n$$z$$",
+		"<ul>\n\t<li>item <span class=\"math display\">\\[y\\]</span></li>\n</ul>\n<p>See\n<span class=\"math display\">\\[E=mc^2\\]</span></p>\n<div class=\"math display\">\\[z\\]</div>",
+	},
+	{
+		"$$\n- x + y\n$$\n\\[\na \\\\ b\n\\]\n\n# Title $$y$$\n\n`$x$` and \\(not math",
+		"<div class=\"math display\">\\[- x + y\\]</div>\n<div class=\"math display\">\\[a \\\\ b\\]</div>\n<h1>Title <span class=\"math display\">\\[y\\]</span></h1>\n<p><code>$x$</code> and (not math</p>",
+	},
+	{
+		"a | b\n--|--\n1 | 2 | 3",
+		"<table>\n\t<tr>\n\t\t<th>a</th>\n\t\t<th>b</th>\n\t</tr>\n\t<tr>\n\t\t<td>1</td>\n\t\t<td>2</td>\n\t\t<td>3</td>\n\t</tr>\n</table>",
+	},
+	{
+		"# Header\nline\\\n\nnext",
+		"<h1>Header</h1>\n<p>line\\</p>\n<p>next</p>",
+	},
+	{
+		"<script>\nif (a*b < c && d*e) { x = \"**\" }\n\n# no\n</script>\n\n" +
+			"*a* <textarea name=t>*b*</textarea> <SPAN markdown=\"0\">*c*</SPAN> <span markdown=\"1\">*d*</span>",
+		"<script>\nif (a*b < c && d*e) { x = \"**\" }\n\n# no\n</script>\n" +
+			"<p><em>a</em> <textarea name=\"t\">*b*</textarea> <span>*c*</span> <span><em>d</em></span></p>",
+	},
+	{
+		"<div class=\"a\">\n# Title <b>bold\n\nSome <span>text\n\nmore</span> and </b>\n\n* <div>item\n* two\n\n<pre>x",
+		"<div class=\"a\">\n\t<h1>Title <b>bold</b></h1>\n\t<p>Some <span>text</span></p>\n\t<p>more and </p>\n" +
+			"\t<ul>\n\t\t<li>\n\t\t\t<div>\n\t\t\t\t<p>item</p>\n\t\t\t</div>\n\t\t</li>\n\t\t<li>two</li>\n\t</ul>\n" +
+			"\t<pre>x</pre>\n</div>",
+	},
+	{
+		"Use a <pre> tag.\n\n# Title\n\n<div markdown=\"0\">*x*\n\n*em*",
+		"<p>Use a </p>\n<pre> tag.</pre>\n<h1>Title</h1>\n<div>*x*</div>\n<p><em>em</em></p>",
+	},
+	{
+		"<ul>\n<li>\none\n\ntwo\n</li>\n</ul>\nafter",
+		"<ul>\n\t<li>one\n\t\t<p>two\n</p>\n\t</li>\n</ul>\n<p>after</p>",
+	},
+	{
+		"<p>\nHello\n\nSecond\n</p>\n\n<p>A <i>b\n\n<b>c</b></p>",
+		"<p>Hello\nSecond\n</p>\n<p>A <i>b</i>\n<b>c</b></p>",
+	},
+	{
+		"<!--raw-->\n<div class=\"gen\"><p>*not em*</p></div>\n<!--/raw-->\n\n" +
+			"<!--raw escape-->\n ( *.* ) <tag> & _x_\n<!--/raw-->\n\nInline <!--raw--><b>**</b><!--/raw--> and *em*",
+		"<div class=\"gen\">\n\t<p>*not em*</p>\n</div>\n ( *.* ) &lt;tag&gt; &amp; _x_\n\n" +
+			"<p>Inline <b>**</b> and <em>em</em></p>",
+	},
+	{
+		"<pre>\n- a | b\n\n*x* <b>y</b>\n</pre>\n\n<div markdown=\"0\">*x* <div>*y*</div> *z*</div>\n\n<pre markdown=\"1\">*yes*</pre>",
+		"<pre>\n- a | b\n\n*x* <b>y</b>\n</pre>\n<div>*x* \n\t<div>*y*</div> *z*</div>\n<pre><em>yes</em></pre>",
+	},
 }
 
 func TestMarkdown(t *testing.T) {
@@ -107,3 +301,233 @@ func TestMarkdown(t *testing.T) {
 		}
 	}
 }
+
+func TestHardWraps(t *testing.T) {
+	input := "Roses are red\n*violets* are blue\n\nSugar is sweet"
+	want := "<p>Roses are red<br>\n<em>violets</em> are blue</p>\n<p>Sugar is sweet</p>"
+	if got, _ := MarkdownWithOptions(input, &Options{HardWraps: true}); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// adversarialCases generate inputs of about n bytes that take quadratic time
+// or worse to parse if the scanner searches ahead from every position.
+var adversarialCases = []struct {
+	name  string
+	input func(n int) string
+}{
+	{"text", func(n int) string { return strings.Repeat("a", n) }},
+	{"spaces", func(n int) string { return "a" + strings.Repeat(" ", n) + "b" }},
+	{"indent", func(n int) string { return strings.Repeat(" ", n) + "a" }},
+	{"newlines", func(n int) string { return "a" + strings.Repeat("\n", n) + "b" }},
+	{"tags", func(n int) string { return strings.Repeat("<", n) }},
+	{"dollars", func(n int) string { return strings.Repeat("$a\n\n", n/4) }},
+	{"math", func(n int) string { return strings.Repeat("$a \\( $$ \\[ ", n/12) }},
+	{"display math", func(n int) string { return strings.Repeat("$$\n\\[\n", n/6) }},
+	{"links", func(n int) string { return strings.Repeat("[a](", n/4) }},
+	{"brackets", func(n int) string { return strings.Repeat("[", n/2) + strings.Repeat("]", n/2) }},
+	{"emphasis", func(n int) string { return strings.Repeat("*a ", n/3) }},
+	{"underscores", func(n int) string { return strings.Repeat("a_ _b ", n/6) }},
+	{"backticks", func(n int) string {
+		var buf bytes.Buffer
+		for i := 1; buf.Len() < n; i++ {
+			buf.WriteString(strings.Repeat("`", i) + "a")
+		}
+		return buf.String()
+	}},
+	{"pipes", func(n int) string { return strings.Repeat("a|", n/2) }},
+	{"headers", func(n int) string { return strings.Repeat("#", n) }},
+	{"lists", func(n int) string { return strings.Repeat("- a\n", n/4) }},
+	{"quotes", func(n int) string { return strings.Repeat("> a\n", n/4) }},
+	{"entities", func(n int) string { return strings.Repeat("&a\\", n/3) }},
+	{"end tags", func(n int) string { return strings.Repeat("<b>", n/8) + strings.Repeat("</i>", n/8) }},
+	{"unclosed", func(n int) string { return strings.Repeat("<pre>\n\n", n/7) }},
+	{"attribute lists", func(n int) string { return strings.Repeat("> a\n", n/8) + strings.Repeat("{: .a}\n", n/14) }},
+}
+
+func TestMathElements(t *testing.T) {
+	opts := &Options{
+		InlineMath: &html.Token{Type: html.StartTagToken, DataAtom: atom.Span, Data: "span",
+			Attr: []html.Attribute{{Key: "class", Val: "tex"}}},
+		DisplayMath: &html.Token{Type: html.StartTagToken, DataAtom: atom.P, Data: "p",
+			Attr: []html.Attribute{{Key: "class", Val: "tex-block"}}},
+	}
+	input := "$x$\n\n$$y$$"
+	want := "<p><span class=\"tex\">\\(x\\)</span></p>\n<p class=\"tex-block\">\\[y\\]</p>"
+	if got, _ := MarkdownWithOptions(input, opts); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEquationNumbers(t *testing.T) {
+	input := "# A\n\nSee [@eq:b].\n\n$$a$$ {#eq:a}\n\n# B\n\n$$b$$ {#eq:b}\n\n$$c$$\n\n$$d$$ {#eq:d}"
+	cases := []struct {
+		opts    *Options
+		numbers []string
+	}{
+		{&Options{}, []string{"(1)", "(2)", "(3)"}},
+		{&Options{EquationSection: 1}, []string{"(1.1)", "(2.1)", "(2.2)"}},
+		{&Options{EquationSection: 2}, []string{"(0.1)", "(0.2)", "(0.3)"}},
+		{&Options{EquationSection: 1, EquationNumber: func(section, n int) string {
+			return fmt.Sprintf("[%c%d]", 'A'+section-1, n)
+		}}, []string{"[A1]", "[B1]", "[B2]"}},
+	}
+	for _, c := range cases {
+		want := fmt.Sprintf("<h1>A</h1>\n<p>See <a href=\"#eq:b\">%[2]s</a>.</p>\n"+
+			"<div class=\"math display\" id=\"eq:a\">\\[a\\]<span class=\"equation-number\">%[1]s</span></div>\n"+
+			"<h1>B</h1>\n"+
+			"<div class=\"math display\" id=\"eq:b\">\\[b\\]<span class=\"equation-number\">%[2]s</span></div>\n"+
+			"<div class=\"math display\">\\[c\\]</div>\n"+
+			"<div class=\"math display\" id=\"eq:d\">\\[d\\]<span class=\"equation-number\">%[3]s</span></div>",
+			c.numbers[0], c.numbers[1], c.numbers[2])
+		if got, _ := MarkdownWithOptions(input, c.opts); got != want {
+			t.Errorf("got\n%s\nwant\n%s", got, want)
+		}
+	}
+}
+
+func TestMarkdownE(t *testing.T) {
+	cases := []struct {
+		input string
+		want  []string
+	}{
+		{"# A [link](x)", nil},
+		{"See [the docs] and ![img] here.", []string{
+			"1:5: [the docs] has no (href)",
+			"1:20: ![img] has no (src)",
+		}},
+		{"* item with [bad\n  link] and *[x]*", []string{
+			"1:13: [bad link] has no (href)",
+			"2:14: [x] has no (href)",
+		}},
+		{"> quoted <!--tabel class=\"x\"--> <!-- a comment --> <!--todo fix-->", []string{
+			"1:10: unknown directive \"tabel\"",
+		}},
+		{"a | b\n--|--\n1 | 2 | 3", []string{
+			"3:8: table row has more cells than the header",
+		}},
+		{"a | b\n--|--\n# 1 | 2", []string{
+			"3:1: table row can't contain H1",
+		}},
+		{"```go {hl_lines=[x] linenostart=one}\nx\n```", []string{
+			"1:1: bad hl_lines \"[x]\"",
+			"1:1: bad linenostart \"one\"",
+		}},
+		{"$$a$$ {#eq:a}\n\n> [@eq:b]\n>\n> $$b$$ {#eq:a}", []string{
+			"5:3: duplicate label \"eq:a\"",
+			"3:3: undefined reference to \"eq:b\"",
+		}},
+		{"<div class=\"a\">\n# Title <b>bold\n\nSome <span>text\n\nmore</span> and </b>\n\n* <div>item\n* two\n\n<pre>x", []string{
+			"2:9: <b> has no </b>",
+			"4:6: <span> has no </span>",
+			"6:5: </span> has no <span>",
+			"6:17: </b> has no <b>",
+			"8:3: <div> has no </div>",
+			"11:1: <pre> has no </pre>",
+			"1:1: <div> has no </div>",
+		}},
+		{"<p>Balanced <img src=x> <br/> <em>tags</em></p>", nil},
+		{"Use a <pre> tag.\n\n<script>x\n\n# Title", []string{
+			"1:7: <pre> has no </pre>",
+			"3:1: <script> has no </script>",
+		}},
+		{"<!--/raw-->\n\n<!--raw escape-->\n*open", []string{
+			"1:1: <!--/raw--> closes no raw directive",
+			"3:1: raw directive has no <!--/raw-->",
+		}},
+	}
+	for _, c := range cases {
+		_, diags, err := MarkdownE(c.input, nil)
+		if err != nil {
+			t.Errorf("%q: %v", c.input, err)
+		}
+		var got []string
+		for _, d := range diags {
+			got = append(got, d.String())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got diagnostics %q, want %q", c.input, got, c.want)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cases := []struct {
+		input string
+		opts  Options
+		want  error
+	}{
+		{"# Header\n\nSome *text*", Options{MaxInputSize: 100, MaxDepth: 1, MaxTokens: 10}, nil},
+		{"# Header\n\nSome *text*", Options{MaxInputSize: 10}, ErrLimit{"input size", 10}},
+		{"# Header\n\nSome *text*", Options{MaxTokens: 4}, ErrLimit{"token count", 4}},
+		{"* a\n  * b\n    * c", Options{MaxDepth: 2}, ErrLimit{"nesting depth", 2}},
+		{"> > > a", Options{MaxDepth: 2}, ErrLimit{"nesting depth", 2}},
+		{"***a* [*b*](c)**", Options{MaxDepth: 2}, ErrLimit{"nesting depth", 2}},
+		{"***a* [*b*](c)**", Options{MaxDepth: 3}, nil},
+		{strings.Repeat("> ", 40) + "a", Options{}, nil},
+		{strings.Repeat("- ", 40) + "a", Options{MaxDepth: -1}, nil},
+	}
+	for _, c := range cases {
+		if _, err := MarkdownWithOptions(c.input, &c.opts); err != c.want {
+			t.Errorf("%q: got error %v, want %v", c.input, err, c.want)
+		}
+	}
+}
+
+func TestDefaultDepth(t *testing.T) {
+	stars := strings.Repeat("*", 70)
+	for _, nested := range []string{stars + "a" + stars, strings.Repeat("> ", 40) + "a"} {
+		input := "Intro\n\n" + nested + "\n\nMore text"
+		got, diags, err := MarkdownE(input, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, "<p>Intro</p>\n") || !strings.HasSuffix(got, "\n<p>More text</p>") {
+			t.Errorf("%q: got\n%s", nested, got)
+		}
+		if len(diags) != 1 || diags[0].Msg != "content nested more than 32 deep is left as text" {
+			t.Errorf("%q: got diagnostics %v", nested, diags)
+		}
+	}
+}
+
+func BenchmarkAdversarial(b *testing.B) {
+	for _, c := range adversarialCases {
+		for _, n := range []int{1000, 10000, 100000} {
+			input := c.input(n)
+			b.Run(fmt.Sprintf("%s/%d", c.name, n), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				for i := 0; i < b.N; i++ {
+					Markdown(input)
+				}
+			})
+		}
+	}
+}
+
+// nestingCases generate inputs nested about n levels deep, which would take
+// quadratic time to parse if content past the default depth weren't left as
+// text.
+var nestingCases = []struct {
+	name  string
+	input func(n int) string
+}{
+	{"quotes", func(n int) string { return strings.Repeat(">", n) + " a" }},
+	{"lists", func(n int) string { return strings.Repeat("- ", n) + "a" }},
+	{"emphasis", func(n int) string { return strings.Repeat("*", n) + "a" + strings.Repeat("*", n) }},
+	{"links", func(n int) string { return strings.Repeat("[![", n) + "a" + strings.Repeat("](b)](c)", n) }},
+}
+
+func BenchmarkNesting(b *testing.B) {
+	for _, c := range nestingCases {
+		for _, n := range []int{1000, 10000, 100000} {
+			input := c.input(n)
+			b.Run(fmt.Sprintf("%s/%d", c.name, n), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				for i := 0; i < b.N; i++ {
+					Markdown(input)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,654 @@
+package markdown
+
+import (
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A mathNode is a MathML element, or the text inside a token element such as
+// mi or mo.
+type mathNode struct {
+	tag      string
+	attr     []html.Attribute
+	text     string
+	children []*mathNode
+}
+
+func mathElem(tag string, children ...*mathNode) *mathNode {
+	return &mathNode{tag: tag, children: children}
+}
+
+func mathText(tag, text string) *mathNode {
+	return &mathNode{tag: tag, text: text}
+}
+
+func (n *mathNode) setAttr(key, val string) *mathNode {
+	n.attr = append(n.attr, html.Attribute{Key: key, Val: val})
+	return n
+}
+
+// appendTokens appends the tokens of n and its children to tokens.
+func (n *mathNode) appendTokens(tokens []*html.Token) []*html.Token {
+	a := atom.Lookup([]byte(n.tag))
+	tokens = append(tokens, &html.Token{Type: html.StartTagToken, DataAtom: a, Data: n.tag, Attr: n.attr})
+	if n.text != "" {
+		tokens = append(tokens, text(n.text))
+	}
+	for _, child := range n.children {
+		tokens = child.appendTokens(tokens)
+	}
+	return append(tokens, &html.Token{Type: html.EndTagToken, DataAtom: a, Data: n.tag})
+}
+
+// mathRow returns the single node in nodes, or an mrow of them.
+func mathRow(nodes []*mathNode) *mathNode {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	return mathElem("mrow", nodes...)
+}
+
+// texToMathML converts the common subset of TeX math used in physics pages
+// to a MathML math element, annotated with the TeX it came from.
+func texToMathML(tex string, display bool) ([]*html.Token, error) {
+	t := &texParser{src: tex, display: display}
+	nodes, err := t.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t.pos < len(t.src) {
+		return nil, t.errorf("unexpected %q", t.src[t.pos:t.pos+1])
+	}
+	annotation := mathText("annotation", tex).setAttr("encoding", "application/x-tex")
+	math := mathElem("math", mathElem("semantics", mathElem("mrow", nodes...), annotation))
+	if display {
+		math.setAttr("display", "block")
+	}
+	return math.appendTokens(nil), nil
+}
+
+// texParser is a recursive descent parser for TeX math.
+type texParser struct {
+	src     string
+	pos     int
+	display bool
+	// depth is how deeply the atom being parsed is nested.
+	depth int
+}
+
+// maxTeXDepth is how deeply groups, fences and the arguments of commands
+// may be nested, so that the parser can't run out of stack.
+const maxTeXDepth = 200
+
+func (t *texParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("TeX at %d: %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+func (t *texParser) skipSpace() {
+	for t.pos < len(t.src) && strings.IndexByte(" \t\n\r", t.src[t.pos]) >= 0 {
+		t.pos++
+	}
+}
+
+// peekCommand returns the name of the command at the current position, if
+// there is one.
+func (t *texParser) peekCommand() string {
+	if t.pos+1 >= len(t.src) || t.src[t.pos] != '\\' {
+		return ""
+	}
+	i := t.pos + 1
+	for i < len(t.src) && isASCIILetter(t.src[i]) {
+		i++
+	}
+	if i == t.pos+1 {
+		return t.src[i : i+1]
+	}
+	return t.src[t.pos+1 : i]
+}
+
+// atEnd reports whether the current position ends an expression: the end of
+// the input or a group, a table cell or row, or a \right or \end.
+func (t *texParser) atEnd() bool {
+	t.skipSpace()
+	if t.pos >= len(t.src) || t.src[t.pos] == '}' || t.src[t.pos] == '&' {
+		return true
+	}
+	switch t.peekCommand() {
+	case "\\", "right", "end":
+		return true
+	}
+	return false
+}
+
+// parseExpr parses a sequence of terms.
+func (t *texParser) parseExpr() ([]*mathNode, error) {
+	var nodes []*mathNode
+	for !t.atEnd() {
+		n, err := t.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// parseTerm parses an atom with any subscript, superscript or primes.
+func (t *texParser) parseTerm() (*mathNode, error) {
+	start := t.pos
+	base, err := t.parseAtom()
+	if err != nil || base == nil {
+		return base, err
+	}
+	limits := t.display && movableLimits[strings.TrimPrefix(t.src[start:t.pos], "\\")]
+	var sub, sup *mathNode
+	for {
+		t.skipSpace()
+		if t.pos >= len(t.src) {
+			break
+		}
+		c := t.src[t.pos]
+		if c == '\'' {
+			t.pos++
+			primes := "′"
+			for t.pos < len(t.src) && t.src[t.pos] == '\'' {
+				t.pos++
+				primes += "′"
+			}
+			sup = mathText("mo", primes)
+			continue
+		}
+		if c != '_' && c != '^' {
+			break
+		}
+		t.pos++
+		arg, err := t.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		if c == '_' {
+			sub = arg
+		} else {
+			sup = arg
+		}
+	}
+	switch {
+	case sub != nil && sup != nil && limits:
+		return mathElem("munderover", base, sub, sup), nil
+	case sub != nil && sup != nil:
+		return mathElem("msubsup", base, sub, sup), nil
+	case sub != nil && limits:
+		return mathElem("munder", base, sub), nil
+	case sub != nil:
+		return mathElem("msub", base, sub), nil
+	case sup != nil && limits:
+		return mathElem("mover", base, sup), nil
+	case sup != nil:
+		return mathElem("msup", base, sup), nil
+	}
+	return base, nil
+}
+
+// parseArg parses the argument of a command or script: a group, or a single
+// character or command.
+func (t *texParser) parseArg() (*mathNode, error) {
+	t.skipSpace()
+	if t.pos >= len(t.src) {
+		return nil, t.errorf("missing argument")
+	}
+	if t.src[t.pos] == '{' {
+		nodes, err := t.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		return mathRow(nodes), nil
+	}
+	n, err := t.parseAtom()
+	if err == nil && n == nil {
+		return mathElem("mrow"), nil
+	}
+	return n, err
+}
+
+// parseGroup parses a group in braces.
+func (t *texParser) parseGroup() ([]*mathNode, error) {
+	t.skipSpace()
+	if t.pos >= len(t.src) || t.src[t.pos] != '{' {
+		return nil, t.errorf("expected {")
+	}
+	t.pos++
+	nodes, err := t.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t.pos >= len(t.src) || t.src[t.pos] != '}' {
+		return nil, t.errorf("expected }")
+	}
+	t.pos++
+	return nodes, nil
+}
+
+// parseRaw returns the text of a group in braces without parsing it, such as
+// the argument of \text or \begin.
+func (t *texParser) parseRaw() (string, error) {
+	t.skipSpace()
+	if t.pos >= len(t.src) || t.src[t.pos] != '{' {
+		return "", t.errorf("expected {")
+	}
+	depth := 0
+	for i := t.pos; i < len(t.src); i++ {
+		switch t.src[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				s := t.src[t.pos+1 : i]
+				t.pos = i + 1
+				return s, nil
+			}
+		}
+	}
+	return "", t.errorf("expected }")
+}
+
+// parseAtom parses a single element, or returns nil for something that
+// doesn't produce one, such as a space.
+func (t *texParser) parseAtom() (*mathNode, error) {
+	if t.depth >= maxTeXDepth {
+		return nil, t.errorf("nested more than %d deep", maxTeXDepth)
+	}
+	t.depth++
+	defer func() { t.depth-- }()
+	t.skipSpace()
+	c := t.src[t.pos]
+	switch {
+	case c == '{':
+		nodes, err := t.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		return mathElem("mrow", nodes...), nil
+	case c == '\\':
+		return t.parseCommand()
+	case c >= '0' && c <= '9' || c == '.' && t.pos+1 < len(t.src) && isDigit(t.src[t.pos+1]):
+		start := t.pos
+		for t.pos < len(t.src) && (isDigit(t.src[t.pos]) ||
+			t.src[t.pos] == '.' && t.pos+1 < len(t.src) && isDigit(t.src[t.pos+1])) {
+			t.pos++
+		}
+		return mathText("mn", t.src[start:t.pos]), nil
+	case c == '}' || c == '&':
+		return nil, t.errorf("unexpected %c", c)
+	case c == '^' || c == '_':
+		// A script with nothing before it applies to an empty base.
+		return mathElem("mrow"), nil
+	}
+	r, size := utf8.DecodeRuneInString(t.src[t.pos:])
+	t.pos += size
+	if unicode.IsLetter(r) {
+		return mathText("mi", string(r)), nil
+	}
+	if op, ok := texOperators[r]; ok {
+		return mathText("mo", op), nil
+	}
+	return mathText("mo", string(r)), nil
+}
+
+// parseCommand parses a command starting with a backslash.
+func (t *texParser) parseCommand() (*mathNode, error) {
+	name := t.peekCommand()
+	if name == "" {
+		return nil, t.errorf("unexpected \\ at end")
+	}
+	t.pos += 1 + len(name)
+	if r, ok := greek[name]; ok {
+		n := mathText("mi", r)
+		if unicode.IsUpper([]rune(r)[0]) {
+			n.setAttr("mathvariant", "normal")
+		}
+		return n, nil
+	}
+	if s, ok := texSymbols[name]; ok {
+		return mathText(s.tag, s.text), nil
+	}
+	if w, ok := texSpaces[name]; ok {
+		return mathElem("mspace").setAttr("width", w), nil
+	}
+	if texFunctions[name] {
+		return mathText("mi", name), nil
+	}
+	if accent, ok := texAccents[name]; ok {
+		arg, err := t.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		tag := "mover"
+		if name == "underline" {
+			tag = "munder"
+		}
+		return mathElem(tag, arg, mathText("mo", accent)).setAttr("accent", "true"), nil
+	}
+	if variant, ok := texFonts[name]; ok {
+		arg, err := t.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		setVariant(arg, variant)
+		return arg, nil
+	}
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num, err := t.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		den, err := t.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		return mathElem("mfrac", num, den), nil
+	case "binom":
+		n, err := t.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		k, err := t.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		frac := mathElem("mfrac", n, k).setAttr("linethickness", "0")
+		return mathElem("mrow", mathText("mo", "("), frac, mathText("mo", ")")), nil
+	case "sqrt":
+		var index *mathNode
+		t.skipSpace()
+		if t.pos < len(t.src) && t.src[t.pos] == '[' {
+			end := strings.IndexByte(t.src[t.pos:], ']')
+			if end < 0 {
+				return nil, t.errorf("expected ]")
+			}
+			inner := &texParser{src: t.src[t.pos+1 : t.pos+end], display: t.display}
+			nodes, err := inner.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			index = mathRow(nodes)
+			t.pos += end + 1
+		}
+		arg, err := t.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		if index != nil {
+			return mathElem("mroot", arg, index), nil
+		}
+		return mathElem("msqrt", arg), nil
+	case "text", "textrm", "mbox", "textit", "textbf":
+		s, err := t.parseRaw()
+		if err != nil {
+			return nil, err
+		}
+		return mathText("mtext", s), nil
+	case "operatorname":
+		s, err := t.parseRaw()
+		if err != nil {
+			return nil, err
+		}
+		return mathText("mi", s), nil
+	case "left":
+		return t.parseFenced()
+	case "begin":
+		return t.parseEnvironment()
+	}
+	return nil, t.errorf("unknown command \\%s", name)
+}
+
+// parseDelimiter parses the delimiter after \left or \right, where . means
+// no delimiter.
+func (t *texParser) parseDelimiter() (*mathNode, error) {
+	t.skipSpace()
+	if t.pos >= len(t.src) {
+		return nil, t.errorf("missing delimiter")
+	}
+	if t.src[t.pos] == '.' {
+		t.pos++
+		return nil, nil
+	}
+	n, err := t.parseAtom()
+	if err != nil {
+		return nil, err
+	}
+	if n == nil || n.tag != "mo" {
+		return nil, t.errorf("bad delimiter")
+	}
+	return n.setAttr("stretchy", "true"), nil
+}
+
+// parseFenced parses the expression between \left and \right.
+func (t *texParser) parseFenced() (*mathNode, error) {
+	open, err := t.parseDelimiter()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := t.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t.peekCommand() != "right" {
+		return nil, t.errorf("\\left without \\right")
+	}
+	t.pos += len(`\right`)
+	close, err := t.parseDelimiter()
+	if err != nil {
+		return nil, err
+	}
+	if open != nil {
+		nodes = append([]*mathNode{open}, nodes...)
+	}
+	if close != nil {
+		nodes = append(nodes, close)
+	}
+	return mathElem("mrow", nodes...), nil
+}
+
+// environments maps the matrix environments to the delimiters around them.
+var environments = map[string][2]string{
+	"matrix":  {"", ""},
+	"pmatrix": {"(", ")"},
+	"bmatrix": {"[", "]"},
+	"Bmatrix": {"{", "}"},
+	"vmatrix": {"|", "|"},
+	"Vmatrix": {"‖", "‖"},
+	"cases":   {"{", ""},
+	"aligned": {"", ""},
+	"align":   {"", ""},
+	"align*":  {"", ""},
+	"array":   {"", ""},
+}
+
+// parseEnvironment parses a matrix environment, from after its \begin to
+// the end of its \end.
+func (t *texParser) parseEnvironment() (*mathNode, error) {
+	name, err := t.parseRaw()
+	if err != nil {
+		return nil, err
+	}
+	fences, ok := environments[name]
+	if !ok {
+		return nil, t.errorf("unknown environment %s", name)
+	}
+	if name == "array" {
+		// The column specification is ignored.
+		if _, err := t.parseRaw(); err != nil {
+			return nil, err
+		}
+	}
+	table := mathElem("mtable")
+	switch name {
+	case "cases":
+		table.setAttr("columnalign", "left left")
+	case "aligned", "align", "align*":
+		table.setAttr("columnalign", "right left")
+	}
+	tr := mathElem("mtr")
+	for {
+		cell, err := t.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		tr.children = append(tr.children, mathElem("mtd", cell...))
+		if t.pos >= len(t.src) || t.src[t.pos] == '}' {
+			return nil, t.errorf("\\begin{%s} without \\end", name)
+		}
+		if t.src[t.pos] == '&' {
+			t.pos++
+			continue
+		}
+		cmd := t.peekCommand()
+		t.pos += 1 + len(cmd)
+		if cmd == "\\" || cmd == "end" {
+			table.children = append(table.children, tr)
+			tr = mathElem("mtr")
+		}
+		if cmd == "end" {
+			end, err := t.parseRaw()
+			if err != nil {
+				return nil, err
+			}
+			if end != name {
+				return nil, t.errorf("\\begin{%s} ended by \\end{%s}", name, end)
+			}
+			break
+		}
+		if cmd == "right" {
+			return nil, t.errorf("unexpected \\right")
+		}
+	}
+	// A trailing \\ leaves an empty last row.
+	if rows := table.children; len(rows) > 1 {
+		if last := rows[len(rows)-1]; len(last.children) == 1 && len(last.children[0].children) == 0 {
+			table.children = rows[:len(rows)-1]
+		}
+	}
+	nodes := []*mathNode{table}
+	if fences[0] != "" {
+		nodes = append([]*mathNode{mathText("mo", fences[0])}, nodes...)
+	}
+	if fences[1] != "" {
+		nodes = append(nodes, mathText("mo", fences[1]))
+	}
+	return mathRow(nodes), nil
+}
+
+// setVariant sets the mathvariant of the identifiers in n, for font commands
+// like \mathbf.
+func setVariant(n *mathNode, variant string) {
+	if n.tag == "mi" || n.tag == "mn" && variant == "bold" {
+		n.setAttr("mathvariant", variant)
+	}
+	for _, child := range n.children {
+		setVariant(child, variant)
+	}
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+var greek = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ",
+	"varepsilon": "ε", "zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ",
+	"iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ",
+	"omicron": "ο", "pi": "π", "varpi": "ϖ", "rho": "ρ", "varrho": "ϱ",
+	"sigma": "σ", "varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ",
+	"varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ",
+	"Pi": "Π", "Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ",
+	"Omega": "Ω",
+}
+
+// texSymbols maps the commands for operators and symbols to the element and
+// text they become.
+var texSymbols = map[string]struct{ tag, text string }{
+	"sum": {"mo", "∑"}, "prod": {"mo", "∏"}, "coprod": {"mo", "∐"},
+	"int": {"mo", "∫"}, "iint": {"mo", "∬"}, "iiint": {"mo", "∭"},
+	"oint": {"mo", "∮"}, "bigcup": {"mo", "⋃"}, "bigcap": {"mo", "⋂"},
+	"cdot": {"mo", "⋅"}, "times": {"mo", "×"}, "div": {"mo", "÷"},
+	"pm": {"mo", "±"}, "mp": {"mo", "∓"}, "ast": {"mo", "∗"},
+	"circ": {"mo", "∘"}, "bullet": {"mo", "∙"}, "star": {"mo", "⋆"},
+	"oplus": {"mo", "⊕"}, "otimes": {"mo", "⊗"}, "wedge": {"mo", "∧"},
+	"vee": {"mo", "∨"}, "cup": {"mo", "∪"}, "cap": {"mo", "∩"},
+	"setminus": {"mo", "∖"}, "leq": {"mo", "≤"}, "le": {"mo", "≤"}, "geq": {"mo", "≥"}, "ge": {"mo", "≥"},
+	"neq": {"mo", "≠"}, "ne": {"mo", "≠"}, "ll": {"mo", "≪"}, "gg": {"mo", "≫"},
+	"approx": {"mo", "≈"}, "equiv": {"mo", "≡"}, "sim": {"mo", "∼"},
+	"simeq": {"mo", "≃"}, "cong": {"mo", "≅"}, "propto": {"mo", "∝"},
+	"in": {"mo", "∈"}, "notin": {"mo", "∉"}, "ni": {"mo", "∋"},
+	"subset": {"mo", "⊂"}, "supset": {"mo", "⊃"}, "subseteq": {"mo", "⊆"},
+	"supseteq": {"mo", "⊇"}, "perp": {"mo", "⊥"}, "parallel": {"mo", "∥"},
+	"mid": {"mo", "∣"}, "to": {"mo", "→"}, "rightarrow": {"mo", "→"}, "leftarrow": {"mo", "←"},
+	"gets": {"mo", "←"}, "leftrightarrow": {"mo", "↔"}, "Rightarrow": {"mo", "⇒"},
+	"Leftarrow": {"mo", "⇐"}, "Leftrightarrow": {"mo", "⇔"}, "implies": {"mo", "⟹"},
+	"iff": {"mo", "⟺"}, "mapsto": {"mo", "↦"}, "uparrow": {"mo", "↑"},
+	"downarrow": {"mo", "↓"}, "forall": {"mo", "∀"}, "exists": {"mo", "∃"}, "neg": {"mo", "¬"},
+	"lnot": {"mo", "¬"}, "land": {"mo", "∧"}, "lor": {"mo", "∨"},
+	"langle": {"mo", "⟨"}, "rangle": {"mo", "⟩"}, "lfloor": {"mo", "⌊"},
+	"rfloor": {"mo", "⌋"}, "lceil": {"mo", "⌈"}, "rceil": {"mo", "⌉"},
+	"{": {"mo", "{"}, "}": {"mo", "}"}, "|": {"mo", "‖"}, "vert": {"mo", "|"},
+	"Vert": {"mo", "‖"}, "lvert": {"mo", "|"}, "rvert": {"mo", "|"},
+	"ldots": {"mo", "…"}, "dots": {"mo", "…"}, "cdots": {"mo", "⋯"},
+	"vdots": {"mo", "⋮"}, "ddots": {"mo", "⋱"}, "prime": {"mo", "′"},
+	"%": {"mo", "%"}, "$": {"mo", "$"}, "#": {"mo", "#"}, "&": {"mo", "&"},
+	"_": {"mo", "_"}, "infty": {"mi", "∞"}, "partial": {"mi", "∂"}, "nabla": {"mi", "∇"},
+	"hbar": {"mi", "ℏ"}, "ell": {"mi", "ℓ"}, "Re": {"mi", "ℜ"}, "Im": {"mi", "ℑ"},
+	"aleph": {"mi", "ℵ"}, "emptyset": {"mi", "∅"}, "angle": {"mi", "∠"},
+	"degree": {"mi", "°"}, "triangle": {"mi", "△"},
+}
+
+// texOperators maps characters to the operators they're written as.
+var texOperators = map[rune]string{
+	'-': "−",
+	'*': "∗",
+}
+
+// texFunctions is the set of named functions, set upright.
+var texFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true, "csc": true,
+	"arcsin": true, "arccos": true, "arctan": true, "sinh": true, "cosh": true,
+	"tanh": true, "coth": true, "log": true, "ln": true, "lg": true, "exp": true,
+	"lim": true, "max": true, "min": true, "sup": true, "inf": true, "det": true,
+	"dim": true, "ker": true, "arg": true, "deg": true, "gcd": true, "Pr": true,
+}
+
+// movableLimits is the set of operators whose scripts go above and below
+// them in display math.
+var movableLimits = map[string]bool{
+	"sum": true, "prod": true, "coprod": true, "bigcup": true, "bigcap": true,
+	"lim": true, "max": true, "min": true, "sup": true, "inf": true, "det": true,
+	"gcd": true, "Pr": true,
+}
+
+var texSpaces = map[string]string{
+	",": "0.1667em", ":": "0.2222em", ">": "0.2222em", ";": "0.2778em",
+	"!": "-0.1667em", " ": "0.25em", "quad": "1em", "qquad": "2em",
+}
+
+var texAccents = map[string]string{
+	"hat": "^", "widehat": "^", "bar": "¯", "overline": "‾", "vec": "→",
+	"dot": "˙", "ddot": "¨", "tilde": "~", "widetilde": "~", "underline": "_",
+}
+
+var texFonts = map[string]string{
+	"mathrm": "normal", "mathbf": "bold", "mathit": "italic",
+	"mathbb": "double-struck", "mathcal": "script", "mathfrak": "fraktur",
+	"mathsf": "sans-serif", "mathtt": "monospace", "boldsymbol": "bold-italic",
+}
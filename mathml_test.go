@@ -0,0 +1,122 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"strings"
+	"testing"
+)
+
+var mathMLCases = []struct {
+	tex, want string
+}{
+	{
+		"E = mc^2",
+		"<mi>E</mi><mo>=</mo><mi>m</mi><msup><mi>c</mi><mn>2</mn></msup>",
+	},
+	{
+		`\frac{1}{2} m v_0^2 - x'`,
+		"<mfrac><mn>1</mn><mn>2</mn></mfrac><mi>m</mi><msubsup><mi>v</mi><mn>0</mn><mn>2</mn></msubsup>" +
+			"<mo>−</mo><msup><mi>x</mi><mo>′</mo></msup>",
+	},
+	{
+		`\alpha \Omega \hbar \cdot \leq`,
+		`<mi>α</mi><mi mathvariant="normal">Ω</mi><mi>ℏ</mi><mo>⋅</mo><mo>≤</mo>`,
+	},
+	{
+		`\sqrt{x} \sqrt[3]{8}`,
+		"<msqrt><mi>x</mi></msqrt><mroot><mn>8</mn><mn>3</mn></mroot>",
+	},
+	{
+		`\sum_{n=1}^N \int_0^\infty`,
+		"<msubsup><mo>∑</mo><mrow><mi>n</mi><mo>=</mo><mn>1</mn></mrow><mi>N</mi></msubsup>" +
+			"<msubsup><mo>∫</mo><mn>0</mn><mi>∞</mi></msubsup>",
+	},
+	{
+		`\sin\theta \, \vec{F} \mathbf{x} \text{if } 3.14`,
+		`<mi>sin</mi><mi>θ</mi><mspace width="0.1667em"></mspace><mover accent="true"><mi>F</mi><mo>→</mo></mover>` +
+			`<mi mathvariant="bold">x</mi><mtext>if </mtext><mn>3.14</mn>`,
+	},
+	{
+		`\left( \frac{a}{b} \right.`,
+		`<mrow><mo stretchy="true">(</mo><mfrac><mi>a</mi><mi>b</mi></mfrac></mrow>`,
+	},
+	{
+		`\begin{pmatrix} a & b \\ c & d \\ \end{pmatrix}`,
+		"<mrow><mo>(</mo><mtable><mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr>" +
+			"<mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr></mtable><mo>)</mo></mrow>",
+	},
+}
+
+func TestTeXToMathML(t *testing.T) {
+	for _, c := range mathMLCases {
+		tokens, err := texToMathML(c.tex, false)
+		if err != nil {
+			t.Errorf("%s: %v", c.tex, err)
+			continue
+		}
+		var got strings.Builder
+		for _, tok := range tokens {
+			got.WriteString(tok.String())
+		}
+		want := "<math><semantics><mrow>" + c.want +
+			`</mrow><annotation encoding="application/x-tex">` + html.EscapeString(c.tex) + "</annotation></semantics></math>"
+		if got.String() != want {
+			t.Errorf("got\n%s\nwant\n%s", got.String(), want)
+		}
+	}
+}
+
+func TestTeXToMathMLErrors(t *testing.T) {
+	for _, tex := range []string{
+		`\frac{a}`,
+		`{x`,
+		`x}`,
+		`\unknown`,
+		`\left( x`,
+		`\begin{pmatrix} a & b`,
+		`\begin{pmatrix} a \end{bmatrix}`,
+		`x^`,
+	} {
+		if _, err := texToMathML(tex, false); err == nil {
+			t.Errorf("%s: want error", tex)
+		}
+	}
+}
+
+func TestTeXDepth(t *testing.T) {
+	for _, tex := range []string{
+		strings.Repeat(`\left(`, 400000),
+		strings.Repeat("{", 400000) + strings.Repeat("}", 400000),
+		strings.Repeat(`\frac`, 400000),
+	} {
+		input := "$$" + tex + "$$"
+		got, diags, err := MarkdownE(input, &Options{MathML: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "<div class=\"math display\">\\["+html.EscapeString(tex)+"\\]</div>" {
+			t.Errorf("%.20s: want the TeX left as it is", tex)
+		}
+		if len(diags) != 1 || !strings.HasSuffix(diags[0].Msg, "nested more than 200 deep") {
+			t.Errorf("%.20s: got diagnostics %v", tex, diags)
+		}
+	}
+}
+
+func TestMathMLOption(t *testing.T) {
+	input := "$$\\sum_i x_i$$\n\nBad $\\foo$"
+	want := "<div class=\"math display\"><math display=\"block\"><semantics><mrow>" +
+		"<munder><mo>∑</mo><mi>i</mi></munder><msub><mi>x</mi><mi>i</mi></msub></mrow>" +
+		"<annotation encoding=\"application/x-tex\">\\sum_i x_i</annotation></semantics></math></div>\n" +
+		"<p>Bad <span class=\"math inline\">\\(\\foo\\)</span></p>"
+	got, diags, err := MarkdownE(input, &Options{MathML: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if len(diags) != 1 || diags[0].String() != `3:5: can't convert math to MathML: TeX at 4: unknown command \foo` {
+		t.Errorf("got diagnostics %v", diags)
+	}
+}
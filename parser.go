@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -20,59 +23,194 @@ func (e ErrUnexpectedToken) Error() string {
 	return fmt.Sprintf("%v", e.tok)
 }
 
+// ErrLimit is returned when the input exceeds one of the limits set in
+// Options.
+type ErrLimit struct {
+	Limit string
+	Max   int
+}
+
+func (e ErrLimit) Error() string {
+	return fmt.Sprintf("markdown: %s exceeds the limit of %d", e.Limit, e.Max)
+}
+
+// A Position is a line and byte column in the input, both starting at 1.
+type Position struct {
+	Line, Col int
+}
+
+// A Diagnostic describes a problem with the input that the parser recovered
+// from, such as link text without a link.
+type Diagnostic struct {
+	Pos Position
+	Msg string
+	// File is the path of the included file the problem is in, or "" if it's
+	// in the input.
+	File string
+}
+
+func (d Diagnostic) String() string {
+	if d.File != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Pos.Line, d.Pos.Col, d.Msg)
+	}
+	return fmt.Sprintf("%d:%d: %s", d.Pos.Line, d.Pos.Col, d.Msg)
+}
+
 type Parser struct {
 	pos        int
 	input      []*Token
+	src        string
+	offsets    []int
 	tokens     []*html.Token
 	inlineMode bool
+	// paragraph is whether a paragraph the parser started is still open.
+	// Inline content isn't always in one, as after an HTML span that starts
+	// a line.
+	paragraph  bool
 	saved      savePoint
 	tableAttrs []html.Attribute
+	opts       Options
+	depth      int
+	state      *parseState
+	lines      []int
+	origins    []Position
+	// file is the path in Options.FS of the file being parsed, or "" for the
+	// input, and includes are the files including it. Headers in it are
+	// moved down by headerOffset levels.
+	file         string
+	includes     []string
+	headerOffset int
+	// open are the HTML elements started in the input and not yet ended,
+	// and opened counts them by name.
+	open   []openElement
+	opened map[string]int
+	// attrsBlock is the block an attribute list was last added to.
+	attrsBlock attrsBlock
+}
+
+// parseState is shared by a parser and the parsers of the blocks and spans
+// nested inside it.
+type parseState struct {
+	tokens int
+	err    error
+	diags  []Diagnostic
+	// The section and equation counters, the numbers of the labelled
+	// equations and the references to them, which are resolved once the
+	// whole document has been parsed.
+	section, equation int
+	labels            map[string]string
+	refs              []reference
+}
+
+// A reference is the text of a link to a labelled equation, to be replaced
+// with the equation's number.
+type reference struct {
+	label string
+	text  *html.Token
+	pos   Position
+	file  string
 }
 
 type savePoint struct {
-	pos, tokenCount int
-	inlineMode      bool
+	pos, tokenCount, open int
+	inlineMode, paragraph bool
 }
 
+// Parse converts Markdown to HTML tokens. It has no way to report an error,
+// so if the parser fails it returns the input as text instead.
 func Parse(input string) []*html.Token {
-	p := &Parser{}
+	tokens, err := ParseWithOptions(input, nil)
+	if err != nil {
+		return []*html.Token{text(input)}
+	}
+	return tokens
+}
+
+// ParseWithOptions is like Parse, but configured by opts. A nil opts is the
+// same as the zero Options.
+func ParseWithOptions(input string, opts *Options) ([]*html.Token, error) {
+	tokens, _, err := ParseE(input, opts)
+	return tokens, err
+}
+
+// ParseE is like ParseWithOptions, but also returns diagnostics for the
+// problems in the input it recovered from. It never panics: it returns an
+// error if the input exceeds a limit or the parser fails.
+func ParseE(input string, opts *Options) (tokens []*html.Token, diags []Diagnostic, err error) {
+	p := &Parser{state: &parseState{}}
+	if opts != nil {
+		p.opts = *opts
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tokens, diags, err = nil, p.state.diags, fmt.Errorf("markdown: internal error: %v", r)
+		}
+	}()
+	if max := p.opts.MaxInputSize; max > 0 && len(input) > max {
+		return nil, nil, ErrLimit{"input size", max}
+	}
 	p.parse(NewScanner(input))
-	return p.tokens
+	if p.state.err != nil {
+		return nil, p.state.diags, p.state.err
+	}
+	p.resolveRefs()
+	if p.opts.Policy != nil {
+		return p.opts.Policy.Sanitize(p.tokens), p.state.diags, nil
+	}
+	return p.tokens, p.state.diags, nil
 }
 
 func (p *Parser) parse(scanner scanner) {
-	for tok := scanner.Next(); tok.Type != EOF; tok = scanner.Next() {
-		p.input = append(p.input, tok)
+	if p.state == nil {
+		p.state = &parseState{}
 	}
-	for tok := p.next(); tok.Type != EOF; tok = p.next() {
+	p.scan(scanner)
+	for tok := p.next(); tok.Type != EOF && p.state.err == nil; tok = p.next() {
 		p.consume(tok)
 	}
-	if p.inlineMode {
-		p.append(endP)
-		p.inlineMode = false
-	}
+	p.block()
+	p.closeElements(0)
+	tokens := p.tokens[:0]
 	for i := 0; i < len(p.tokens); i++ {
-		tok := p.tokens[i]
-		if tok == startP {
-			emptyParagraph := true
-			start := i
-			i++
-			for ; i < len(p.tokens); i++ {
-				tok := p.tokens[i]
-				if tok == endP {
-					break
-				}
-				if tok.Type != html.TextToken || strings.TrimSpace(tok.Data) != "" {
-					emptyParagraph = false
-					break
-				}
-			}
-			if emptyParagraph {
-				p.tokens = append(p.tokens[:start], p.tokens[i+1:]...)
-				i = start + 1
+		if p.tokens[i] == startP {
+			if end := emptyParagraph(p.tokens, i); end >= 0 {
+				i = end
+				continue
 			}
 		}
+		tokens = append(tokens, p.tokens[i])
 	}
+	p.tokens = tokens
+}
+
+// emptyParagraph returns the index of the end of the paragraph starting at
+// start if it has only whitespace in it, or -1.
+func emptyParagraph(tokens []*html.Token, start int) int {
+	for i := start + 1; i < len(tokens); i++ {
+		if tokens[i] == endP {
+			return i
+		}
+		if tokens[i].Type != html.TextToken || strings.TrimSpace(tokens[i].Data) != "" {
+			break
+		}
+	}
+	return -1
+}
+
+// scan reads the input tokens, recording the source each one starts at.
+func (p *Parser) scan(scanner scanner) {
+	var src bytes.Buffer
+	for tok := scanner.Next(); tok.Type != EOF; tok = scanner.Next() {
+		p.state.tokens++
+		if max := p.opts.MaxTokens; max > 0 && p.state.tokens > max {
+			p.fail(ErrLimit{"token count", max})
+			break
+		}
+		p.offsets = append(p.offsets, src.Len())
+		p.input = append(p.input, tok)
+		src.WriteString(tok.Raw)
+	}
+	p.src = src.String()
 }
 
 func (p *Parser) consume(tok *Token) {
@@ -83,48 +221,86 @@ func (p *Parser) consume(tok *Token) {
 		p.parseHeader(tok.Type)
 	case CODE_BLOCK:
 		p.parseCodeBlock(tok)
-	case ORDERED_LIST:
-		p.parseOrderedList()
-	case UNORDERED_LIST:
-		p.parseUnorderedList()
+	case ORDERED_LIST, UNORDERED_LIST:
+		p.parseList(tok)
+	case BLOCKQUOTE:
+		p.parseBlockquote(tok)
+	case ADMONITION:
+		p.parseAdmonition(tok)
+	case DETAILS:
+		p.parseDetails(tok)
 	case TD:
 		err = p.parseTD()
+	case TEXT:
+		atLineStart := p.pos < 2 || p.input[p.pos-2].Type == NEWLINE
+		if attrs := p.blockAttrList(p.pos - 1); atLineStart && attrs != nil && p.addBlockAttrs(attrs) {
+			break
+		}
+		p.consumeInline(tok)
 	default:
 		p.consumeInline(tok)
 	}
 	if err != nil {
+		if e, ok := err.(ErrUnexpectedToken); ok {
+			p.warnf(p.pos-1, "table row can't contain %v", e.tok.Type)
+		}
 		p.revert()
 	}
 }
 
 func (p *Parser) consumeInline(tok *Token) {
 	p.save()
+	start := len(p.tokens)
 	var err error
 	switch tok.Type {
 	case EM:
 		p.parseEm(tok.Lit)
+		p.parseSpanAttrs(start)
 	case STRONG:
 		p.parseStrong(tok.Lit)
+		p.parseSpanAttrs(start)
 	case NEWLINE:
 		p.parseNewline()
 	case TEXT:
 		p.parseText(tok.Lit)
 	case LINK_TEXT:
-		err = p.parseLink(tok.Lit)
+		if p.peek().Type != HREF && refRe.MatchString(tok.Lit) {
+			p.parseRef(tok.Lit[1:])
+			p.parseSpanAttrs(start)
+			break
+		}
+		if err = p.parseLink(tok.Lit); err == nil {
+			p.parseSpanAttrs(start)
+		}
 	case IMG_ALT:
-		err = p.parseImg(tok.Lit)
+		if err = p.parseImg(tok.Lit); err == nil {
+			p.parseSpanAttrs(start)
+		}
 	case CODE:
 		p.parseCode(tok.Lit)
 	case HTML_TAG:
 		p.parseHTMLTag(tok.Lit)
+	case RAW_HTML:
+		p.parseRawHTML(tok.Lit)
+	case RAW:
+		p.parseRawDirective(tok.Lit)
 	case MATHML:
-		p.parseText(tok.Lit)
+		p.parseMath(tok.Lit, false, "")
+	case MATH_BLOCK:
+		p.parseMath(tok.Lit, true, equationLabel(tok.Raw))
 	case HREF:
 		p.parseText(tok.Raw)
 	default:
-		panic(fmt.Sprintf("unknown token type: %v", tok.Type))
+		p.warnf(p.saved.pos, "unexpected %v", tok.Type)
+		p.parseText(tok.Raw)
 	}
 	if err != nil {
+		text := strings.Replace(tok.Lit, "\n", " ", -1)
+		if tok.Type == LINK_TEXT {
+			p.warnf(p.saved.pos, "[%s] has no (href)", text)
+		} else {
+			p.warnf(p.saved.pos, "![%s] has no (src)", text)
+		}
 		p.revert()
 	}
 }
@@ -140,7 +316,9 @@ func (p *Parser) expect(tok TokenType) (string, error) {
 func (p *Parser) save() {
 	p.saved.pos = p.pos - 1
 	p.saved.tokenCount = len(p.tokens)
+	p.saved.open = len(p.open)
 	p.saved.inlineMode = p.inlineMode
+	p.saved.paragraph = p.paragraph
 }
 
 func (p *Parser) revert() {
@@ -149,10 +327,65 @@ func (p *Parser) revert() {
 		buf.WriteString(p.input[i].Raw)
 	}
 	p.tokens = p.tokens[:p.saved.tokenCount]
+	for len(p.open) > p.saved.open {
+		p.popElement()
+	}
 	p.inlineMode = p.saved.inlineMode
+	p.paragraph = p.saved.paragraph
 	p.parseText(buf.String())
 }
 
+// fail records the first error that stops parsing.
+func (p *Parser) fail(err error) {
+	if p.state.err == nil {
+		p.state.err = err
+	}
+}
+
+// warnf records a diagnostic at the start of the i'th input token.
+func (p *Parser) warnf(i int, format string, args ...interface{}) {
+	offset := len(p.src)
+	if i >= 0 && i < len(p.offsets) {
+		offset = p.offsets[i]
+	}
+	p.state.diags = append(p.state.diags, Diagnostic{p.position(offset), fmt.Sprintf(format, args...), p.file})
+}
+
+// position returns the position in the input of an offset in p.src. The
+// source of nested content has the same lines as the input it came from, so
+// its positions are found from the positions of the starts of its lines.
+func (p *Parser) position(offset int) Position {
+	if p.lines == nil {
+		p.lines = []int{0}
+		for i := 0; i < len(p.src); i++ {
+			if p.src[i] == '\n' {
+				p.lines = append(p.lines, i+1)
+			}
+		}
+	}
+	line := sort.SearchInts(p.lines, offset+1) - 1
+	if line < len(p.origins) {
+		origin := p.origins[line]
+		return Position{origin.Line, origin.Col + offset - p.lines[line]}
+	}
+	return Position{line + 1, offset - p.lines[line] + 1}
+}
+
+// lineStarts returns the offsets in the source of the lines of s, which is
+// the source at offset with characters removed from the start of some of
+// its lines.
+func lineStarts(s, src string, offset int) []int {
+	lines, srcLines := strings.Split(s, "\n"), strings.Split(src, "\n")
+	starts := make([]int, len(lines))
+	for i := range lines {
+		if i < len(srcLines) {
+			starts[i] = offset + len(srcLines[i]) - len(lines[i])
+			offset += len(srcLines[i]) + 1
+		}
+	}
+	return starts
+}
+
 func (p *Parser) next() *Token {
 	if p.pos >= len(p.input) {
 		return &Token{EOF, "EOF", ""}
@@ -181,30 +414,83 @@ func (p *Parser) append(tok *html.Token) {
 
 func (p *Parser) inline() {
 	if !p.inlineMode {
-		p.append(startP)
-		p.inlineMode = true
+		p.startParagraph()
 	}
 }
 
 func (p *Parser) block() {
 	if p.inlineMode {
-		p.append(endP)
+		p.closeInline()
+		if p.paragraph {
+			p.append(endP)
+			p.paragraph = false
+		}
 		p.inlineMode = false
 	}
 }
 
+func (p *Parser) startParagraph() {
+	p.append(startP)
+	p.inlineMode = true
+	p.paragraph = true
+}
+
+// directiveRe matches the name at the start of a comment that looks like a
+// directive, such as <!--table class="table"-->.
+var directiveRe = regexp.MustCompile(`^([a-z]+)(?:\s|$)`)
+
+// unknownDirectiveRe matches a comment that isn't a known directive but has
+// quoted attributes after its name, so it's likely a mistyped one rather than
+// a note such as <!--todo fix-->.
+var unknownDirectiveRe = regexp.MustCompile(`^[a-z]+(?:\s+[\w:.-]+=(?:"[^"]*"|'[^']*'))+\s*$`)
+
 func (p *Parser) handleDirective(s string) bool {
-	if strings.HasPrefix(s, "table ") {
-		tt := html.NewTokenizer(strings.NewReader("<" + s + ">"))
-		tt.Next()
-		tok := tt.Token()
+	if name, ok := strings.CutPrefix(strings.TrimSpace(s), "/"); ok && pairedDirectives[name] {
+		p.warnf(p.pos-1, "<!--/%s--> closes no %s directive", name, name)
+		return true
+	}
+	m := directiveRe.FindStringSubmatch(s)
+	if m == nil {
+		return false
+	}
+	tt := html.NewTokenizer(strings.NewReader("<" + s + ">"))
+	tt.Next()
+	tok := tt.Token()
+	switch m[1] {
+	case "table":
 		p.tableAttrs = tok.Attr
 		return true
+	case "code":
+		p.parseCodeDirective(tok.Attr)
+		return true
+	case "include":
+		p.parseIncludeDirective(tok.Attr)
+		return true
+	case "details":
+		p.parseDetailsDirective(tok.Attr)
+		return true
+	}
+	if unknownDirectiveRe.MatchString(s) {
+		p.warnf(p.pos-1, "unknown directive %q", m[1])
 	}
 	return false
 }
 
 func (p *Parser) parseHeader(headerToken TokenType) {
+	if p.headerOffset != 0 {
+		level := int(headerToken-H1) + 1 + p.headerOffset
+		if level < 1 {
+			level = 1
+		} else if level > 6 {
+			level = 6
+		}
+		headerToken = headers[level]
+	}
+	if p.opts.EquationSection > 0 && headerToken == headers[p.opts.EquationSection] {
+		p.state.section++
+		p.state.equation = 0
+	}
+	start := len(p.tokens)
 	p.append(hStartTag[headerToken])
 	p.inlineMode = true
 	for {
@@ -213,12 +499,19 @@ func (p *Parser) parseHeader(headerToken TokenType) {
 			p.next()
 			break
 		}
-		if next.Type == ORDERED_LIST || next.Type == UNORDERED_LIST {
+		if next.Type == ORDERED_LIST || next.Type == UNORDERED_LIST || next.Type == BLOCKQUOTE {
 			break
 		}
 		p.next()
+		if next.Type == TD {
+			// A header can't be part of a table, so any pipes are text.
+			p.parseText(next.Raw)
+			continue
+		}
 		p.consumeInline(next)
 	}
+	p.closeInline()
+	p.headerAttrs(start)
 	p.append(hEndTag[headerToken])
 	p.inlineMode = false
 }
@@ -226,34 +519,95 @@ func (p *Parser) parseHeader(headerToken TokenType) {
 func (p *Parser) parseEm(lit string) {
 	p.inline()
 	p.append(startEm)
-	p.append(text(lit))
+	p.parseInline(lit, p.litOffset(p.pos-1, lit))
 	p.append(endEm)
 }
 
 func (p *Parser) parseStrong(lit string) {
 	p.inline()
 	p.append(startStrong)
-	p.append(text(lit))
+	p.parseInline(lit, p.litOffset(p.pos-1, lit))
 	p.append(endStrong)
 }
 
+// parseInline parses the content of a span or table cell, found at offset in
+// the source, as inline Markdown.
+func (p *Parser) parseInline(s string, offset int) {
+	p.tokens = append(p.tokens, p.inlineTokens(s, offset)...)
+}
+
+func (p *Parser) inlineTokens(s string, offset int) []*html.Token {
+	child := p.child(lineStarts(s, s, offset))
+	if child == nil {
+		return []*html.Token{text(s)}
+	}
+	child.inlineMode = true
+	child.scan(newInlineScanner(s))
+	for tok := child.next(); tok.Type != EOF; tok = child.next() {
+		child.consumeInline(tok)
+	}
+	child.closeElements(0)
+	return child.tokens
+}
+
 func (p *Parser) parseNewline() {
-	next := p.next()
+	next := p.peek()
 	if next.Type == NEWLINE {
+		p.next()
+		if p.inlineMode && !p.paragraph && p.inPhrasing() {
+			// A blank line inside an element such as p, which can't
+			// contain paragraphs, only ends the spans before it.
+			p.closeInline()
+			p.append(text("\n"))
+			return
+		}
 		p.block()
 	} else {
 		if next.Type == EOF || (next.Type == TEXT && strings.TrimSpace(next.Lit) == "") {
+			p.next()
 			return
 		}
+		if attrs := p.blockAttrList(p.pos); attrs != nil && p.addBlockAttrs(attrs) {
+			p.next()
+			return
+		}
+		if p.lineBreak() {
+			p.append(br)
+		}
+		p.next()
 		p.tokens = append(p.tokens, text("\n"))
 		p.consume(next)
 	}
 }
 
+// lineBreak reports whether the newline just consumed is a hard line break,
+// because the line ends with two or more spaces or a backslash, or because
+// every newline is one. The marker and any trailing spaces are removed from
+// the text before it.
+func (p *Parser) lineBreak() bool {
+	if !p.inlineMode {
+		return false
+	}
+	hard := p.opts.HardWraps
+	prev := p.prev()
+	if p.pos < 2 || p.input[p.pos-2].Type != TEXT || prev.Type != html.TextToken {
+		return hard
+	}
+	raw := p.input[p.pos-2].Raw
+	trimmed := strings.TrimRight(raw, " ")
+	if len(raw)-len(trimmed) >= 2 {
+		hard = true
+	} else if n := len(raw) - len(strings.TrimRight(raw, "\\")); n%2 == 1 {
+		prev.Data = strings.TrimSuffix(prev.Data, "\\")
+		hard = true
+	}
+	prev.Data = strings.TrimRight(prev.Data, " ")
+	return hard
+}
+
 func (p *Parser) parseText(s string) {
 	if !p.inlineMode {
-		p.append(startP)
-		p.inlineMode = true
+		p.startParagraph()
 		s = strings.TrimLeft(s, " ")
 	}
 	p.append(text(s))
@@ -261,6 +615,7 @@ func (p *Parser) parseText(s string) {
 
 func (p *Parser) parseLink(s string) error {
 	p.inline()
+	offset := p.litOffset(p.pos-1, s)
 	href, err := p.expect(HREF)
 	if err != nil {
 		return err
@@ -274,13 +629,14 @@ func (p *Parser) parseLink(s string) error {
 			Val: href,
 		}},
 	})
-	p.append(text(s))
+	p.parseInline(s, offset)
 	p.append(endA)
 	return nil
 }
 
 func (p *Parser) parseImg(alt string) error {
 	p.inline()
+	offset := p.litOffset(p.pos-1, alt)
 	src, err := p.expect(HREF)
 	if err != nil {
 		return err
@@ -290,42 +646,138 @@ func (p *Parser) parseImg(alt string) error {
 		DataAtom: atom.Img,
 		Data:     "img",
 		Attr: []html.Attribute{
-			{Key: "alt", Val: alt},
+			{Key: "alt", Val: textContent(p.inlineTokens(alt, offset))},
 			{Key: "src", Val: src},
 		},
 	})
 	return nil
 }
 
-func (p *Parser) parseCode(code string) {
-	p.inline()
-	p.append(startCode)
-	p.append(text(code))
-	p.append(endCode)
+// parseMath wraps math in the element set in Options, with the delimiters
+// MathJax and KaTeX look for. Display math inside inline content, such as a
+// paragraph or header, is wrapped in a span instead of a block element, so
+// only math that starts a block is rendered as one. Labelled math is
+// numbered, and its element gets the label as its id.
+func (p *Parser) parseMath(tex string, display bool, label string) {
+	start, delims := p.opts.InlineMath, [2]string{`\(`, `\)`}
+	if start == nil {
+		start = startMathInline
+	}
+	if display {
+		start, delims = p.opts.DisplayMath, [2]string{`\[`, `\]`}
+		if start == nil {
+			start = startMathDisplay
+		}
+	}
+	if p.inlineMode && blockTag[start.DataAtom] {
+		span := *start
+		span.DataAtom, span.Data = atom.Span, "span"
+		start = &span
+	}
+	if label != "" {
+		labelled := *start
+		labelled.Attr = append(append([]html.Attribute(nil), start.Attr...), html.Attribute{Key: "id", Val: label})
+		start = &labelled
+	}
+	if !blockTag[start.DataAtom] {
+		p.inline()
+	}
+	p.append(start)
+	var math []*html.Token
+	if p.opts.MathML {
+		var err error
+		if math, err = texToMathML(tex, display); err != nil {
+			p.warnf(p.pos-1, "can't convert math to MathML: %v", err)
+		}
+	}
+	if math == nil {
+		math = []*html.Token{text(delims[0] + tex + delims[1])}
+	}
+	p.tokens = append(p.tokens, math...)
+	if label != "" {
+		p.append(startEquationNumber)
+		p.append(text(p.numberEquation(label)))
+		p.append(endSpan)
+	}
+	p.append(&html.Token{Type: html.EndTagToken, DataAtom: start.DataAtom, Data: start.Data})
 }
 
-func (p *Parser) parseCodeBlock(tok *Token) error {
-	p.append(startPre)
-	var code string
-	if strings.Count(tok.Lit, "\n") > 0 {
-		lang := strings.Split(tok.Lit, "\n")[0]
-		p.tokens = append(p.tokens, &html.Token{
-			Type:     html.StartTagToken,
-			DataAtom: atom.Code,
-			Data:     "code",
-			Attr: []html.Attribute{
-				{Key: "class", Val: lang},
-			},
-		})
-		code = tok.Lit[len(lang)+1:]
+// numberEquation returns the number of the next labelled equation, and
+// records it for the references to label.
+func (p *Parser) numberEquation(label string) string {
+	p.state.equation++
+	var number string
+	switch {
+	case p.opts.EquationNumber != nil:
+		number = p.opts.EquationNumber(p.state.section, p.state.equation)
+	case p.opts.EquationSection > 0:
+		number = fmt.Sprintf("(%d.%d)", p.state.section, p.state.equation)
+	default:
+		number = fmt.Sprintf("(%d)", p.state.equation)
+	}
+	if p.state.labels == nil {
+		p.state.labels = make(map[string]string)
+	}
+	if _, ok := p.state.labels[label]; ok {
+		p.warnf(p.pos-1, "duplicate label %q", label)
 	} else {
-		p.append(startCode)
-		code = tok.Lit
+		p.state.labels[label] = number
+	}
+	return number
+}
+
+var (
+	labelRe = regexp.MustCompile(`\{#([^\s{}]+)\}$`)
+	refRe   = regexp.MustCompile(`^@[\w:.-]+$`)
+)
+
+// equationLabel returns the label at the end of the source of display math,
+// or "" if it has none.
+func equationLabel(raw string) string {
+	if groups := labelRe.FindStringSubmatch(raw); groups != nil {
+		return groups[1]
+	}
+	return ""
+}
+
+// parseRef parses a reference to a labelled equation, as in [@eq:newton],
+// which links to the equation. Its text is set to the equation's number by
+// resolveRefs, since the equation may come later in the document.
+func (p *Parser) parseRef(label string) {
+	p.inline()
+	p.append(&html.Token{
+		Type:     html.StartTagToken,
+		DataAtom: atom.A,
+		Data:     "a",
+		Attr: []html.Attribute{{
+			Key: "href",
+			Val: "#" + label,
+		}},
+	})
+	number := text("")
+	p.append(number)
+	p.append(endA)
+	p.state.refs = append(p.state.refs, reference{label, number, p.position(p.offsets[p.pos-1]), p.file})
+}
+
+// resolveRefs sets the text of each reference to the number of its equation,
+// or ?? if there's no equation with its label.
+func (p *Parser) resolveRefs() {
+	for _, ref := range p.state.refs {
+		number, ok := p.state.labels[ref.label]
+		if !ok {
+			number = "??"
+			p.state.diags = append(p.state.diags, Diagnostic{ref.pos, fmt.Sprintf("undefined reference to %q", ref.label), ref.file})
+		}
+		ref.text.Data = number
 	}
-	p.append(text(strings.TrimSpace(code)))
+}
+
+func (p *Parser) parseCode(code string) {
+	p.inline()
+	p.append(startCode)
+	p.append(text(code))
 	p.append(endCode)
-	p.append(endPre)
-	return nil
 }
 
 func (p *Parser) parseHTMLTag(tag string) {
@@ -336,91 +788,469 @@ func (p *Parser) parseHTMLTag(tag string) {
 		if p.handleDirective(tok.Data) {
 			return
 		}
+		p.append(&tok)
+		return
+	}
+	p.appendHTML(&tok)
+}
+
+// parseRawHTML parses an HTML element whose content isn't Markdown, such as
+// a script element, which is added as it is. If it has no end tag, it's
+// closed at the end of the block it's in, with a diagnostic.
+func (p *Parser) parseRawHTML(s string) {
+	tokens := htmlTokens(s)
+	if len(tokens) == 0 {
+		return
+	}
+	block, open := !p.inlineMode, len(p.open)
+	p.appendHTML(tokens[0])
+	if len(tokens) > 1 {
+		p.tokens = append(p.tokens, tokens[1:len(tokens)-1]...)
+		if last := tokens[len(tokens)-1]; last.Type == html.EndTagToken && last.Data == tokens[0].Data {
+			p.appendHTML(last)
+		} else {
+			p.append(last)
+		}
+	}
+	// An element without an end tag ends with its block.
+	p.closeElements(open)
+	// A script or style element between blocks doesn't start a paragraph.
+	if block && rawText[tokens[0].DataAtom] {
+		p.inlineMode = false
+	}
+}
+
+// parseRawDirective parses a raw directive, whose content up to the closing
+// <!--/raw--> is added as HTML as it is, without being parsed as Markdown,
+// or as text with an escape attribute, as in <!--raw escape-->. It's only
+// put in a paragraph if it's inside one.
+func (p *Parser) parseRawDirective(s string) {
+	start := rawDirectiveRe.FindString(s)
+	content, closed := strings.CutSuffix(s[len(start):], rawDirectiveClose)
+	if !closed {
+		p.warnf(p.pos-1, "raw directive has no %s", rawDirectiveClose)
+	}
+	tt := html.NewTokenizer(strings.NewReader("<" + strings.TrimSuffix(start[len("<!--"):], "-->") + ">"))
+	tt.Next()
+	if hasAttr(tt.Token().Attr, "escape") {
+		p.append(text(content))
 	} else {
-		if !p.inlineMode && inline(&tok) &&
-			(tok.Type == html.StartTagToken && inlineBlock[tok.DataAtom]) {
-			p.append(startP)
-			p.inlineMode = true
-		} else if p.inlineMode && !inline(&tok) &&
-			!(tok.Type == html.EndTagToken && inlineBlock[tok.DataAtom]) {
-			p.append(endP)
-			p.inlineMode = false
+		// The line breaks around HTML on lines of its own are left to
+		// PrettyPrint.
+		content = strings.TrimSuffix(strings.TrimPrefix(content, "\n"), "\n")
+		p.tokens = append(p.tokens, htmlTokens(content)...)
+	}
+}
+
+// appendHTML appends an HTML tag, ending or starting a paragraph around it
+// if need be, and removes its markdown attribute, which says whether its
+// content is Markdown. An end tag without an open element to end is left
+// out.
+func (p *Parser) appendHTML(tok *html.Token) {
+	if tok.Type == html.EndTagToken && !p.endElement(tok) {
+		return
+	}
+	if !p.inlineMode && inline(tok) &&
+		(tok.Type == html.StartTagToken && inlineBlock[tok.DataAtom]) {
+		p.startParagraph()
+	} else if p.inlineMode && !inline(tok) &&
+		!(tok.Type == html.EndTagToken && inlineBlock[tok.DataAtom] && !p.paragraph) {
+		// A paragraph started inside an element such as li ends with it.
+		p.block()
+	}
+	// The content of a block such as a header or summary is inline.
+	if blockTag[tok.DataAtom] && !(tok.Type == html.StartTagToken && inlineBlock[tok.DataAtom]) {
+		p.inlineMode = false
+	} else {
+		p.inlineMode = true
+	}
+	for i, attr := range tok.Attr {
+		if attr.Key == "markdown" {
+			tok.Attr = append(tok.Attr[:i:i], tok.Attr[i+1:]...)
+			break
 		}
-		if blockTag[tok.DataAtom] {
-			p.inlineMode = false
-		} else {
-			p.inlineMode = true
+	}
+	if tok.Type == html.StartTagToken && !voidElement[tok.DataAtom] {
+		p.open = append(p.open, openElement{tok, p.pos - 1})
+		if p.opened == nil {
+			p.opened = make(map[string]int)
+		}
+		p.opened[tok.Data]++
+	}
+	p.append(tok)
+}
+
+// An openElement is an HTML element started in the input and not yet ended.
+type openElement struct {
+	tok *html.Token
+	pos int // the input token that started it
+}
+
+// endElement removes the element an end tag ends from the open elements,
+// first ending those opened inside it, and reports whether there was one.
+func (p *Parser) endElement(tok *html.Token) bool {
+	// The open elements are only searched if one has the tag's name, so
+	// that stray end tags don't take quadratic time.
+	if p.opened[tok.Data] == 0 {
+		p.warnf(p.pos-1, "</%s> has no <%s>", tok.Data, tok.Data)
+		return false
+	}
+	i := len(p.open) - 1
+	for p.open[i].tok.Data != tok.Data {
+		i--
+	}
+	p.closeElements(i + 1)
+	p.popElement()
+	return true
+}
+
+func (p *Parser) popElement() openElement {
+	el := p.open[len(p.open)-1]
+	p.open = p.open[:len(p.open)-1]
+	p.opened[el.tok.Data]--
+	return el
+}
+
+// closeElements ends the open elements after the first n, with a diagnostic
+// for each, since they should have been ended already.
+func (p *Parser) closeElements(n int) {
+	for len(p.open) > n {
+		el := p.popElement()
+		p.warnf(el.pos, "<%s> has no </%s>", el.tok.Data, el.tok.Data)
+		p.append(&html.Token{Type: html.EndTagToken, DataAtom: el.tok.DataAtom, Data: el.tok.Data})
+	}
+}
+
+// inPhrasing reports whether the innermost open HTML element that isn't
+// inline can only contain inline content.
+func (p *Parser) inPhrasing() bool {
+	for i := len(p.open) - 1; i >= 0; i-- {
+		if tok := p.open[i].tok; !inline(tok) {
+			return phrasingTag[tok.DataAtom]
 		}
 	}
-	p.append(&tok)
+	return false
+}
+
+// closeInline ends the open inline elements, such as spans, at the end of
+// the paragraph or header they're in.
+func (p *Parser) closeInline() {
+	n := len(p.open)
+	for n > 0 && inline(p.open[n-1].tok) {
+		n--
+	}
+	p.closeElements(n)
 }
 
-func (p *Parser) parseOrderedList() {
+// parseList parses a run of sibling items with the same kind of marker. The content
+// of each item, including any lists nested inside it, is parsed as a
+// document of its own. A list is loose if any of its items are separated by
+// blank lines or contain blocks separated by blank lines, in which case the
+// paragraphs inside its items are kept.
+func (p *Parser) parseList(tok *Token) {
 	p.block()
-	depth := 0
-	p.inlineMode = true
-	p.append(startOl)
-	p.append(startLi)
-	for tok := p.next(); tok.Type != EOF && tok.Type != NEWLINE; tok = p.next() {
-		if tok.Type == ORDERED_LIST {
-			d := len(tok.Lit)
-			if d > depth {
-				p.append(startOl)
-				p.append(startLi)
-			} else if d < depth {
-				p.append(endLi)
-				p.append(endOl)
-				p.append(endLi)
-				p.append(startLi)
-			} else {
-				p.append(endLi)
-				p.append(startLi)
-			}
-			depth = d
-		} else {
-			p.consumeInline(tok)
+	start := listStartTag[tok.Type]
+	if _, n := listMarker(tok); tok.Type == ORDERED_LIST && n != 1 {
+		start = &html.Token{
+			Type:     html.StartTagToken,
+			DataAtom: atom.Ol,
+			Data:     "ol",
+			Attr: []html.Attribute{
+				{Key: "start", Val: strconv.Itoa(n)},
+			},
 		}
 	}
-	for ; depth >= 0; depth-- {
+	var items []string
+	var itemStarts [][]int
+	loose := false
+	for {
+		item, starts := p.listItem(tok)
+		items = append(items, item)
+		itemStarts = append(itemStarts, starts)
+		loose = loose || looseItem(item)
+		next, blank := p.siblingItem(tok)
+		if next == nil {
+			break
+		}
+		loose = loose || blank
+		tok = next
+	}
+	p.append(start)
+	for i, item := range items {
+		p.append(startLi)
+		if loose {
+			p.tokens = append(p.tokens, p.parseNested(item, itemStarts[i])...)
+		} else {
+			p.appendTight(p.parseNested(item, itemStarts[i]))
+		}
 		p.append(endLi)
-		p.append(endOl)
 	}
-	p.inlineMode = false
+	p.append(listEndTag[tok.Type])
+	if p.peek().Type == NEWLINE {
+		p.next()
+	}
 }
 
-func (p *Parser) parseUnorderedList() {
+// listItem consumes the input belonging to the list item opened by tok and
+// returns its source with the item's indentation removed, and where each of
+// its lines starts. An item continues
+// through lines indented past its marker, including those after blank lines,
+// and through unindented lines that continue its paragraph.
+func (p *Parser) listItem(tok *Token) (string, []int) {
+	indent := len(tok.Lit)
+	start := p.offsets[p.pos-1] + len(tok.Raw)
+	end := lineEnd(p.src, start)
+	blank := false
+	for pos := end; pos < len(p.src); {
+		next := lineEnd(p.src, pos+1)
+		line := p.src[pos+1 : next]
+		pos = next
+		if strings.TrimSpace(line) == "" {
+			blank = true
+			continue
+		}
+		if lineIndent(line) <= indent && (blank || blockStart.MatchString(line)) {
+			break
+		}
+		end, blank = next, false
+	}
+	src := p.consumeTo(start, end)
+	item := dedent(src, len(strings.TrimLeft(tok.Raw, "\n")))
+	return item, lineStarts(item, src, start)
+}
+
+// siblingItem consumes the marker of the next item in the list continued by
+// prev, skipping any blank lines before it. A marker of a different type,
+// bullet character or delimiter starts a new list instead. It reports whether
+// blank lines separated the item from the previous one.
+func (p *Parser) siblingItem(prev *Token) (*Token, bool) {
+	delim, _ := listMarker(prev)
+	newlines := 0
+	for i := p.pos; i < len(p.input); i++ {
+		tok := p.input[i]
+		if tok.Type == prev.Type {
+			if d, _ := listMarker(tok); d != delim {
+				break
+			}
+			p.pos = i + 1
+			newlines += len(tok.Raw) - len(strings.TrimLeft(tok.Raw, "\n"))
+			return tok, newlines > 1
+		}
+		if strings.TrimSpace(tok.Raw) != "" {
+			break
+		}
+		newlines += strings.Count(tok.Raw, "\n")
+	}
+	return nil, false
+}
+
+// parseBlockquote parses the lines of a block quote, with their quote markers
+// removed, as a document of its own.
+func (p *Parser) parseBlockquote(tok *Token) {
 	p.block()
+	start := p.offsets[p.pos-1] + len(tok.Raw) - len(strings.TrimLeft(tok.Raw, "\n"))
+	var lines []string
+	end := start
+	for end < len(p.src) {
+		next := lineEnd(p.src, end)
+		line := p.src[end:next]
+		if m := blockquoteMarker.FindString(line); m != "" {
+			lines = append(lines, line[len(m):])
+		} else if strings.TrimSpace(line) != "" && !blockStart.MatchString(line) {
+			lines = append(lines, line)
+		} else {
+			break
+		}
+		end = next + 1
+	}
+	if end > len(p.src) {
+		end = len(p.src)
+	}
+	src := p.consumeTo(start, end)
+	quote := strings.Join(lines, "\n")
+	p.append(startBlockquote)
+	p.tokens = append(p.tokens, p.parseNested(quote, lineStarts(quote, src, start))...)
+	p.append(endBlockquote)
+	if p.peek().Type == NEWLINE {
+		p.next()
+	}
+}
+
+// consumeTo consumes the tokens starting before end and returns the source
+// from start to the end of the last token consumed.
+func (p *Parser) consumeTo(start, end int) string {
+	for p.pos < len(p.input) && p.offsets[p.pos] < end {
+		p.pos++
+	}
+	if p.pos < len(p.input) {
+		end = p.offsets[p.pos]
+	} else {
+		end = len(p.src)
+	}
+	return p.src[start:end]
+}
+
+// defaultMaxDepth is how deeply blocks and spans may be nested if
+// Options.MaxDepth is zero. The source of each is parsed again as a document
+// of its own, so parsing input nested n deep takes n times as long.
+const defaultMaxDepth = 32
+
+func (p *Parser) parseNested(src string, starts []int) []*html.Token {
+	child := p.child(starts)
+	if child == nil {
+		return []*html.Token{text(src)}
+	}
+	child.parse(NewScanner(src))
+	return child.tokens
+}
+
+// child returns a parser for content nested inside the current block or
+// span, whose lines start at the given offsets, or nil if it would be nested
+// too deeply. Past the default limit, the content is left as text.
+func (p *Parser) child(starts []int) *Parser {
+	if max := p.opts.MaxDepth; max > 0 && p.depth >= max {
+		p.fail(ErrLimit{"nesting depth", max})
+		return nil
+	}
+	if p.opts.MaxDepth == 0 && p.depth >= defaultMaxDepth {
+		p.warnf(p.pos-1, "content nested more than %d deep is left as text", defaultMaxDepth)
+		return nil
+	}
+	origins := make([]Position, len(starts))
+	for i, start := range starts {
+		origins[i] = p.position(start)
+	}
+	return &Parser{
+		tableAttrs:   p.tableAttrs,
+		opts:         p.opts,
+		depth:        p.depth + 1,
+		state:        p.state,
+		origins:      origins,
+		file:         p.file,
+		includes:     p.includes,
+		headerOffset: p.headerOffset,
+	}
+}
+
+// litOffset returns the offset in the source of lit inside the i'th input
+// token.
+func (p *Parser) litOffset(i int, lit string) int {
+	if j := strings.Index(p.input[i].Raw, lit); j > 0 {
+		return p.offsets[i] + j
+	}
+	return p.offsets[i]
+}
+
+// appendTight appends tokens with their top-level paragraph tags removed.
+func (p *Parser) appendTight(tokens []*html.Token) {
 	depth := 0
-	p.inlineMode = true
-	p.append(startUl)
-	p.append(startLi)
-	for tok := p.next(); tok.Type != EOF && tok.Type != NEWLINE; tok = p.next() {
-		if tok.Type == UNORDERED_LIST {
-			d := len(tok.Lit)
-			if d > depth {
-				p.append(startUl)
-				p.append(startLi)
-			} else if d < depth {
-				for ; depth > d; depth-- {
-					p.append(endLi)
-					p.append(endUl)
+	for _, tok := range tokens {
+		if depth == 0 && (tok == startP || tok == endP) {
+			continue
+		}
+		if blockTag[tok.DataAtom] && tok.DataAtom != atom.P {
+			if tok.Type == html.StartTagToken {
+				depth++
+			} else if tok.Type == html.EndTagToken {
+				depth--
+			}
+		}
+		p.append(tok)
+	}
+}
+
+// listMarker returns the bullet character or delimiter of a list marker
+// token, along with the number an ordered list item starts at.
+func listMarker(tok *Token) (byte, int) {
+	m := strings.TrimLeft(tok.Raw, "\n\t ")
+	digits := len(m) - len(strings.TrimLeft(m, "0123456789"))
+	if digits == len(m) {
+		return 0, 0
+	}
+	n, _ := strconv.Atoi(m[:digits])
+	return m[digits], n
+}
+
+// textContent returns the text of tokens without any markup, such as for
+// the alt text of an image.
+func textContent(tokens []*html.Token) string {
+	var buf bytes.Buffer
+	for _, tok := range tokens {
+		if tok.Type == html.TextToken {
+			buf.WriteString(tok.Data)
+		} else if tok.DataAtom == atom.Img {
+			for _, attr := range tok.Attr {
+				if attr.Key == "alt" {
+					buf.WriteString(attr.Val)
 				}
-				p.append(endLi)
-				p.append(startLi)
-			} else {
-				p.append(endLi)
-				p.append(startLi)
 			}
-			depth = d
+		}
+	}
+	return buf.String()
+}
+
+func lineEnd(s string, start int) int {
+	if i := strings.IndexByte(s[start:], '\n'); i >= 0 {
+		return start + i
+	}
+	return len(s)
+}
+
+func lineIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, "\t "))
+}
+
+var (
+	blockStart       = regexp.MustCompile("^[\t ]*(?:[*+-][\t ]|\\d+[.)][\t ]|#|>|<|```|\\{:)")
+	listItemStart    = regexp.MustCompile(`^[\t ]*(?:[*+-]|\d+[.)])[\t ]`)
+	blockquoteMarker = regexp.MustCompile(`^[\t ]*>[\t ]?`)
+	fence            = regexp.MustCompile("^[\t ]*```")
+)
+
+// dedent removes the indentation common to every line after the first, up to
+// max characters.
+func dedent(s string, max int) string {
+	lines := strings.Split(s, "\n")
+	n := max
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) != "" && lineIndent(line) < n {
+			n = lineIndent(line)
+		}
+	}
+	for i := 1; i < len(lines); i++ {
+		if lineIndent(lines[i]) < n {
+			lines[i] = strings.TrimLeft(lines[i], "\t ")
 		} else {
-			p.consumeInline(tok)
+			lines[i] = lines[i][n:]
 		}
 	}
-	for ; depth >= 0; depth-- {
-		p.append(endLi)
-		p.append(endUl)
+	return strings.Join(lines, "\n")
+}
+
+// looseItem reports whether a list item's content has blocks directly inside
+// it separated by blank lines. Blank lines inside fenced code and between the
+// items of a nested list don't count.
+func looseItem(item string) bool {
+	inFence, inList, blank := false, false, false
+	for _, line := range strings.Split(item, "\n")[1:] {
+		if fence.MatchString(line) {
+			inFence = !inFence
+		}
+		if inFence {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			blank = true
+			continue
+		}
+		marker := listItemStart.MatchString(line) && lineIndent(line) == 0
+		if blank && !(inList && (marker || lineIndent(line) > 0)) {
+			return true
+		}
+		inList = inList || marker
+		blank = false
 	}
-	p.inlineMode = false
+	return false
 }
 
 func (p *Parser) parseTD() error {
@@ -436,6 +1266,7 @@ func (p *Parser) parseTD() error {
 	row, col := 0, 0
 	nlCount := 0
 	var styles []*html.Token
+	var attrs []html.Attribute
 	for tok := p.input[p.pos-1]; tok.Type != EOF; tok = p.next() {
 		if tok.Type != TD && tok.Type != EOF && tok.Type != NEWLINE {
 			return ErrUnexpectedToken{tok}
@@ -453,15 +1284,15 @@ func (p *Parser) parseTD() error {
 		} else if tok.Type == TD {
 			if row == 0 {
 				p.append(startTh)
-			} else {
+			} else if col < len(styles) {
 				p.append(styles[col])
+			} else {
+				if col == len(styles) {
+					p.warnf(p.pos-1, "table row has more cells than the header")
+				}
+				p.append(startTd)
 			}
-			scanner := NewScanner(tok.Lit)
-			for tok := scanner.Next(); tok.Type != EOF; tok = scanner.Next() {
-				p.inlineMode = true
-				p.consumeInline(tok)
-				p.inlineMode = false
-			}
+			p.parseInline(tok.Lit, p.litOffset(p.pos-1, tok.Lit))
 			if row == 0 {
 				p.append(endTh)
 			} else {
@@ -470,6 +1301,11 @@ func (p *Parser) parseTD() error {
 			col++
 		}
 		if tok.Type == NEWLINE {
+			// An attribute list on the line after the table ends it.
+			if attrs = p.blockAttrList(p.pos); attrs != nil {
+				p.next()
+				break
+			}
 			if row != 1 && nlCount == 0 && p.peek().Type != NEWLINE {
 				p.append(endTr)
 				p.append(startTr)
@@ -487,5 +1323,8 @@ func (p *Parser) parseTD() error {
 	p.append(endTr)
 	p.append(endTable)
 	p.inlineMode = false
+	if attrs != nil {
+		p.addBlockAttrs(attrs)
+	}
 	return nil
 }
@@ -138,9 +138,9 @@ var parserCases = []*parserCase{
 	{
 		[]Token{
 			{H2, "##", "## "}, {TEXT, "header", "header"},
-			{UNORDERED_LIST, "", "* "}, {TEXT, "foo", "foo"},
-			{UNORDERED_LIST, "", "* "}, {TEXT, "bar", "bar"},
-			{UNORDERED_LIST, "", "* "}, {TEXT, "baz", "baz"}, {NEWLINE, "\n", "\n"},
+			{UNORDERED_LIST, "", "\n* "}, {TEXT, "foo", "foo"},
+			{UNORDERED_LIST, "", "\n* "}, {TEXT, "bar", "bar"},
+			{UNORDERED_LIST, "", "\n* "}, {TEXT, "baz", "baz"}, {NEWLINE, "\n", "\n"},
 		},
 		[]*html.Token{
 			startH2, text("header"), endH2,
@@ -154,8 +154,8 @@ var parserCases = []*parserCase{
 	{
 		[]Token{
 			{ORDERED_LIST, "", "1. "}, {TEXT, "foo", "foo"},
-			{ORDERED_LIST, "", "2. "}, {TEXT, "bar", "bar"},
-			{ORDERED_LIST, "", "2. "}, {TEXT, "baz", "baz"}, {NEWLINE, "\n", "\n"},
+			{ORDERED_LIST, "", "\n2. "}, {TEXT, "bar", "bar"},
+			{ORDERED_LIST, "", "\n2. "}, {TEXT, "baz", "baz"}, {NEWLINE, "\n", "\n"},
 		},
 		[]*html.Token{
 			startOl,
@@ -224,13 +224,15 @@ var parserCases = []*parserCase{
 		[]Token{
 			{HREF, "4.1", "(4.1)"},
 			{TEXT, " ", " "},
-			{MATHML, "$F = ma$", "$F = ma$"},
+			{MATHML, "F = ma", "$F = ma$"},
 		},
 		[]*html.Token{
 			startP,
 			{Type: html.TextToken, Data: "(4.1)"},
 			{Type: html.TextToken, Data: " "},
-			{Type: html.TextToken, Data: "$F = ma$"},
+			startMathInline,
+			{Type: html.TextToken, Data: `\(F = ma\)`},
+			{Type: html.EndTagToken, DataAtom: atom.Span, Data: "span"},
 			endP,
 		},
 	},
@@ -11,6 +11,9 @@ func PrettyPrint(tokens []*html.Token) string {
 	var prev *html.Token
 	for i, token := range tokens {
 		tokenString := token.String()
+		if token.Type == html.TextToken && prev != nil && prev.Type == html.StartTagToken && rawText[prev.DataAtom] {
+			tokenString = token.Data
+		}
 		if !inline(prev) && inline(token) && tokenString == "\n" {
 			continue
 		}
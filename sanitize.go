@@ -0,0 +1,200 @@
+package markdown
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"strings"
+)
+
+// A Policy decides which HTML may appear in the output, for rendering
+// untrusted input. Elements that aren't allowed are removed, keeping their
+// content, except for elements like script and style whose content is removed
+// too. Comments are always removed.
+type Policy struct {
+	// Elements maps the name of each allowed element to the attributes
+	// allowed on it.
+	Elements map[string][]string
+	// URLSchemes lists the schemes allowed in URL attributes such as href and
+	// src. Relative URLs are always allowed.
+	URLSchemes []string
+}
+
+// DefaultPolicy returns a strict policy that allows the elements the parser
+// generates, including MathML, and a few other formatting elements, with
+// only http, https and mailto URLs. It doesn't allow style attributes, so
+// table column alignment is removed. It allows class and id attributes on
+// the elements the parser generates with them, such as highlighted code and
+// admonitions, and that attribute lists may be put on.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Elements: map[string][]string{
+			"a":          {"href", "title", "class", "id"},
+			"abbr":       {"title"},
+			"b":          nil,
+			"blockquote": {"class", "id"},
+			"br":         nil,
+			"code":       {"class", "id"},
+			"dd":         nil,
+			"del":        nil,
+			"details":    {"open", "class", "id"},
+			"div":        {"class", "id"},
+			"dl":         nil,
+			"dt":         nil,
+			"em":         {"class", "id"},
+			"figcaption": {"class", "id"},
+			"figure":     {"class", "id"},
+			"h1":         {"class", "id"},
+			"h2":         {"class", "id"},
+			"h3":         {"class", "id"},
+			"h4":         {"class", "id"},
+			"h5":         {"class", "id"},
+			"h6":         {"class", "id"},
+			"hr":         nil,
+			"i":          nil,
+			"img":        {"src", "alt", "title", "width", "height", "class", "id"},
+			"kbd":        nil,
+			"li":         nil,
+			"ol":         {"start", "class", "id"},
+			"p":          {"class", "id"},
+			"pre":        {"class", "id"},
+			"s":          nil,
+			"span":       {"class", "id"},
+			"strong":     {"class", "id"},
+			"sub":        nil,
+			"summary":    {"class", "id"},
+			"sup":        nil,
+			"table":      {"class", "id"},
+			"tbody":      nil,
+			"td":         nil,
+			"th":         nil,
+			"thead":      nil,
+			"tr":         nil,
+			"ul":         {"class", "id"},
+			// MathML
+			"annotation": {"encoding"},
+			"math":       {"display"},
+			"mfrac":      {"linethickness"},
+			"mi":         {"mathvariant"},
+			"mn":         {"mathvariant"},
+			"mo":         {"stretchy"},
+			"mover":      {"accent"},
+			"mroot":      nil,
+			"mrow":       nil,
+			"mspace":     {"width"},
+			"msqrt":      nil,
+			"msub":       nil,
+			"msubsup":    nil,
+			"msup":       nil,
+			"mtable":     {"columnalign"},
+			"mtd":        nil,
+			"mtext":      nil,
+			"mtr":        nil,
+			"munder":     {"accent"},
+			"munderover": nil,
+			"semantics":  nil,
+		},
+		URLSchemes: []string{"http", "https", "mailto"},
+	}
+}
+
+// dropContent is the set of elements whose content is removed along with
+// them when they aren't allowed.
+var dropContent = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Template: true,
+	atom.Textarea: true,
+	atom.Title:    true,
+	atom.Noscript: true,
+}
+
+// urlAttr is the set of attributes whose values are URLs.
+var urlAttr = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"formaction": true,
+	"href":       true,
+	"longdesc":   true,
+	"poster":     true,
+	"src":        true,
+}
+
+// Sanitize returns the tokens with the HTML the policy doesn't allow removed.
+func (pol *Policy) Sanitize(tokens []*html.Token) []*html.Token {
+	var out []*html.Token
+	var dropping atom.Atom
+	depth := 0
+	for _, tok := range tokens {
+		if depth > 0 {
+			if tok.DataAtom == dropping && tok.Type == html.StartTagToken {
+				depth++
+			} else if tok.DataAtom == dropping && tok.Type == html.EndTagToken {
+				depth--
+			}
+			continue
+		}
+		switch tok.Type {
+		case html.TextToken:
+			out = append(out, tok)
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			attrs, ok := pol.Elements[tok.Data]
+			if !ok {
+				if tok.Type == html.StartTagToken && dropContent[tok.DataAtom] {
+					dropping = tok.DataAtom
+					depth = 1
+				}
+				continue
+			}
+			out = append(out, pol.sanitizeAttrs(tok, attrs))
+		}
+	}
+	return out
+}
+
+// sanitizeAttrs returns tok, or a copy of it without the attributes that
+// aren't allowed.
+func (pol *Policy) sanitizeAttrs(tok *html.Token, allowed []string) *html.Token {
+	var attrs []html.Attribute
+	for _, attr := range tok.Attr {
+		if attr.Namespace == "" && contains(allowed, attr.Key) &&
+			(!urlAttr[attr.Key] || pol.allowURL(attr.Val)) {
+			attrs = append(attrs, attr)
+		}
+	}
+	if len(attrs) == len(tok.Attr) {
+		return tok
+	}
+	clean := *tok
+	clean.Attr = attrs
+	return &clean
+}
+
+// allowURL reports whether url is relative or has an allowed scheme.
+func (pol *Policy) allowURL(url string) bool {
+	// Browsers ignore whitespace and control characters in URLs, so
+	// "java\tscript:" is a javascript: URL.
+	url = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, url)
+	i := strings.IndexAny(url, ":/?#")
+	if i < 0 || url[i] != ':' {
+		return true
+	}
+	return contains(pol.URLSchemes, strings.ToLower(url[:i]))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
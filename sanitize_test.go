@@ -0,0 +1,53 @@
+package markdown
+
+import (
+	"testing"
+)
+
+var sanitizeCases = []testCase{
+	{
+		"Hi <script>alert(\"*x*\")</script> there",
+		"<p>Hi  there</p>",
+	},
+	{
+		"<div onclick=\"evil()\" class=\"x\">Click *me*</div>",
+		"<div class=\"x\">\n\t<p>Click <em>me</em></p>\n</div>",
+	},
+	{
+		"[a](javascript:alert) [b](JaVa&#x09;script:x) [c](/rel) [d](https://ok)",
+		"<p><a>a</a> <a>b</a> <a href=\"/rel\">c</a> <a href=\"https://ok\">d</a></p>",
+	},
+	{
+		"[x](javascript:alert(1))",
+		"<p><a>x</a></p>",
+	},
+	{
+		"![i](data:image/png;base64,xx) <b title=\"t\">b</b><!-- c -->",
+		"<p><img alt=\"i\"/> <b>b</b></p>",
+	},
+	{
+		"a | b\n--|--:\n1 | 2<script>x</script>",
+		"<table>\n\t<tr>\n\t\t<th>a</th>\n\t\t<th>b</th>\n\t</tr>\n\t<tr>\n\t\t<td>1</td>\n\t\t<td>2</td>\n\t</tr>\n</table>",
+	},
+	{
+		"$$x$$ {#eq:x}\n\nSee [@eq:x] and *a*{.b onclick=c}.\n\n!!! note\n    Hi\n\n??? tip\n    Hidden",
+		"<div class=\"math display\" id=\"eq:x\">\\[x\\]<span class=\"equation-number\">(1)</span></div>\n" +
+			"<p>See <a href=\"#eq:x\">(1)</a> and <em class=\"b\">a</em>.</p>\n" +
+			"<div class=\"admonition note\">\n\t<p class=\"admonition-title\">Note</p>\n\t<p>Hi</p>\n</div>\n" +
+			"<details class=\"tip\">\n\t<summary>Tip</summary>\n\t<p>Hidden</p>\n</details>",
+	},
+	{
+		"```go\nreturn\n```",
+		"<pre><code class=\"go\"><span class=\"token keyword\">return</span></code></pre>",
+	},
+}
+
+func TestSanitize(t *testing.T) {
+	for _, c := range sanitizeCases {
+		opts := &Options{Policy: DefaultPolicy(), Highlighters: DefaultHighlighters()}
+		got, _ := MarkdownWithOptions(c.input, opts)
+		if got != c.want {
+			t.Errorf("got\n%s\nwant\n%s", got, c.want)
+		}
+	}
+}
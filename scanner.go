@@ -1,6 +1,8 @@
 package markdown
 
 import (
+	"bytes"
+	"golang.org/x/net/html"
 	"regexp"
 	"strings"
 )
@@ -8,34 +10,56 @@ import (
 type matcher func(s string) *Token
 
 type Scanner struct {
-	pos              int
-	src              string
-	next             *Token
-	matchers         []matcher
-	inOl, inUl, inTd bool
+	pos          int
+	src          string
+	next         *Token
+	matchers     []matcher
+	inList, inTd bool
+	runEnd       int
+	spans        map[int]*Token
+	delims       []*delimiter
+	// The positions below are found once and reused until the scanner moves
+	// past them, rather than searched for from every position, so that
+	// scanning takes linear time.
+	indented  bool           // only indentation precedes pos on its line
+	markerEnd int            // the end of the newlines and indentation at pos
+	cellEnd   int            // the next unescaped | or newline
+	mathEnd   map[string]int // the next closing delimiter of display math
+	blankEnd  int            // the next blank line
+	endTags   map[string]int // the last end tag of each element
 }
 
 func NewScanner(src string) *Scanner {
-	s := &Scanner{
-		src: src,
-	}
-	s.matchers = []matcher{
-		matchHeader,
+	s := newInlineScanner(src)
+	// Raw HTML is matched before blocks too, so that nothing inside it is.
+	s.matchers = append([]matcher{
+		s.matchRawHTML,
+		s.matchHeader,
 		s.matchOrderedList,
 		s.matchUnorderedList,
 		s.matchTD,
-		groupMatcher(regexp.MustCompile("^\r?(\n)"), NEWLINE, false),
-		groupMatcher(regexp.MustCompile(`^\[(.*?)\]`), LINK_TEXT, false),
-		groupMatcher(regexp.MustCompile(`^!\[(.*?)\]`), IMG_ALT, false),
-		groupMatcher(regexp.MustCompile(`^\((.*?)\)`), HREF, false),
-		groupMatcher(regexp.MustCompile(`^(?s)\*\*(.+?)\*\*`), STRONG, true),
-		groupMatcher(regexp.MustCompile(`^(?s)\*(.+?)\*`), EM, true),
-		groupMatcher(regexp.MustCompile(`^(?s)__(.+?)__`), STRONG, true),
-		groupMatcher(regexp.MustCompile(`^(?s)\s_(.+?)_`), EM, true),
-		groupMatcher(regexp.MustCompile("^(?s)```(.*?)```"), CODE_BLOCK, false),
-		groupMatcher(regexp.MustCompile("^`(.*?)`"), CODE, true),
-		groupMatcher(regexp.MustCompile("(?s)^(<.*?>)"), HTML_TAG, false),
-		groupMatcher(regexp.MustCompile("^(?s)([$].*?[$])"), MATHML, true),
+		s.matchBlockquote,
+		s.matchAdmonition,
+	}, s.matchers[1:]...)
+	return s
+}
+
+// newInlineScanner returns a scanner that only matches inline tokens, for
+// content such as table cells that can't contain blocks.
+func newInlineScanner(src string) *Scanner {
+	s := &Scanner{
+		src:       src,
+		indented:  true,
+		markerEnd: -1,
+		cellEnd:   -1,
+		mathEnd:   make(map[string]int),
+	}
+	s.matchers = []matcher{
+		s.matchRawHTML,
+		matchNewline,
+		s.matchCodeBlock,
+		s.matchMathBlock,
+		s.matchSpan,
 	}
 	return s
 }
@@ -52,34 +76,100 @@ func (s *Scanner) Next() *Token {
 			break
 		}
 		if s.pos+1 < len(s.src) && s.src[s.pos] == '\n' && s.src[s.pos+1] == '\n' {
-			s.inOl, s.inUl, s.inTd = false, false, false
+			s.inTd = false
+			if s.pos+2 < len(s.src) && !strings.ContainsRune("\t \n", rune(s.src[s.pos+2])) {
+				s.inList = false
+			}
 		}
-		if s.src[s.pos] == '\\' {
-			s.pos += 2
+		if s.escaped() {
+			s.advance(2)
 			continue
 		}
 		for _, match := range s.matchers {
 			if tok := match(s.src[s.pos:]); tok != nil {
 				if last != s.pos {
-					str := strings.Replace(s.src[last:s.pos], "\\", "", -1)
-					text := &Token{TEXT, str, str}
-					s.pos += len(tok.Raw)
+					text := &Token{TEXT, unescape(s.src[last:s.pos]), s.src[last:s.pos]}
+					s.advance(len(tok.Raw))
 					s.next = tok
 					return text
 				}
-				s.pos += len(tok.Raw)
+				s.advance(len(tok.Raw))
 				return tok
 			}
 		}
-		s.pos++
+		s.advance(1)
 	}
 	if last != s.pos {
-		str := strings.Replace(s.src[last:], "\\", "", -1)
-		return &Token{TEXT, str, str}
+		return &Token{TEXT, unescape(s.src[last:]), s.src[last:]}
 	}
 	return &Token{EOF, "EOF", ""}
 }
 
+// escaped reports whether the current position is a backslash escape, rather
+// than the start of math delimited by \( or \[.
+func (s *Scanner) escaped() bool {
+	if s.src[s.pos] != '\\' || s.pos+1 >= len(s.src) || !isASCIIPunct(s.src[s.pos+1]) {
+		return false
+	}
+	if c := s.src[s.pos+1]; c == '(' || c == '[' {
+		return s.matchMathBlock(s.src[s.pos:]) == nil && s.matchSpan(s.src[s.pos:]) == nil
+	}
+	return true
+}
+
+// advance moves the position forward n bytes, keeping track of whether only
+// indentation precedes it on its line.
+func (s *Scanner) advance(n int) {
+	skipped := s.src[s.pos : s.pos+n]
+	if i := strings.LastIndexByte(skipped, '\n'); i >= 0 {
+		s.indented = true
+		skipped = skipped[i+1:]
+	}
+	s.indented = s.indented && strings.Trim(skipped, "\t ") == ""
+	s.pos += n
+}
+
+// marker returns the first byte after any newlines and indentation at the
+// current position, which must be a block marker for a block to start here.
+func (s *Scanner) marker() byte {
+	if s.pos > s.markerEnd {
+		s.markerEnd = s.pos + len(s.src[s.pos:]) - len(strings.TrimLeft(s.src[s.pos:], "\n\t "))
+	}
+	if s.markerEnd == len(s.src) {
+		return 0
+	}
+	return s.src[s.markerEnd]
+}
+
+var entityRe = regexp.MustCompile(`^&(?:#[xX][0-9a-fA-F]{1,6}|#[0-9]{1,7}|[A-Za-z][A-Za-z0-9]{1,31});`)
+
+// unescape replaces backslash escapes of ASCII punctuation with the escaped
+// character and decodes entity and numeric character references. Backslashes
+// before any other character are kept.
+func unescape(s string) string {
+	if !strings.ContainsAny(s, "\\&") {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]) {
+			i++
+		} else if s[i] == '&' {
+			if ref := entityRe.FindString(s[i:]); ref != "" && html.UnescapeString(ref) != ref {
+				buf.WriteString(html.UnescapeString(ref))
+				i += len(ref) - 1
+				continue
+			}
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
 func groupMatcher(re *regexp.Regexp, tok TokenType, singleLine bool) matcher {
 	return func(s string) *Token {
 		groups := re.FindStringSubmatch(s)
@@ -94,68 +184,395 @@ func groupMatcher(re *regexp.Regexp, tok TokenType, singleLine bool) matcher {
 	}
 }
 
+var newlineMatcher = groupMatcher(regexp.MustCompile("^\r?(\n)"), NEWLINE, false)
+
+// matchNewline matches a newline. The regexp is only tried at a line ending,
+// since it's slow to fail at every position of a long input.
+func matchNewline(str string) *Token {
+	if len(str) == 0 || str[0] != '\r' && str[0] != '\n' {
+		return nil
+	}
+	return newlineMatcher(str)
+}
+
+var codeBlockMatcher = groupMatcher(regexp.MustCompile("^(?s)```(.*?)```"), CODE_BLOCK, false)
+
+// matchCodeBlock matches a fenced code block whose opening fence is at the
+// start of a line. A fence can't have backticks after it, so that a line can
+// begin with a code span.
+func (s *Scanner) matchCodeBlock(str string) *Token {
+	if !s.indented || !strings.HasPrefix(str, "```") {
+		return nil
+	}
+	if strings.Contains(str[3:lineEnd(str, 0)], "`") {
+		return nil
+	}
+	return codeBlockMatcher(str)
+}
+
+// matchMathBlock matches display math delimited by $$ or \[ and \] starting
+// at the start of a line, with an optional label. Unlike display math inside
+// a paragraph, its lines may start with block markers, but it still can't
+// contain a blank line.
+func (s *Scanner) matchMathBlock(str string) *Token {
+	if !s.indented {
+		return nil
+	}
+	var delim string
+	if strings.HasPrefix(str, "$$") {
+		delim = "$$"
+	} else if strings.HasPrefix(str, `\[`) {
+		delim = `\]`
+	} else {
+		return nil
+	}
+	for _, d := range []string{delim, "\n\n"} {
+		if j, ok := s.mathEnd[d]; !ok || j < s.pos+2 {
+			s.mathEnd[d] = nextString(s.src, s.pos+2, d)
+		}
+	}
+	end := s.mathEnd[delim]
+	if end == len(s.src) || s.mathEnd["\n\n"] < end {
+		return nil
+	}
+	label := equationLabelRe.FindString(s.src[end+2:])
+	return &Token{MATH_BLOCK, strings.TrimSpace(s.src[s.pos+2 : end]), s.src[s.pos : end+2+len(label)]}
+}
+
+// equationLabelRe matches the label after display math, as in
+// "$$ F = ma $$ {#eq:newton}".
+var equationLabelRe = regexp.MustCompile(`^[\t ]*\{#([^\s{}]+)\}`)
+
 var headerRe = regexp.MustCompile(`^[\t ]*([#]+)\s*`)
 
-func matchHeader(s string) *Token {
-	groups := headerRe.FindStringSubmatch(s)
-	if len(groups) == 0 {
+func (s *Scanner) matchHeader(str string) *Token {
+	if !s.indented || s.marker() != '#' {
+		return nil
+	}
+	groups := headerRe.FindStringSubmatch(str)
+	if len(groups) == 0 || len(groups[1]) > 6 {
 		return nil
 	}
 	return &Token{headers[len(groups[1])], groups[1], groups[0]}
 }
 
-var orderedListMatcher = groupMatcher(
-	regexp.MustCompile(`^\n*([\t ]*)\d+\.[\t ]+`),
-	ORDERED_LIST,
-	false)
+var orderedListRe = regexp.MustCompile(`^\n*([\t ]*)(\d{1,9})[.)][\t ]+`)
 
+// matchOrderedList matches an ordered list marker at the start of a line. A
+// marker may only interrupt a paragraph if it is already in a list, follows a
+// blank line or starts a new list at 1.
 func (s *Scanner) matchOrderedList(str string) *Token {
-	if !(s.pos == 0 || s.inOl || (len(str) >= 2 && str[0] == '\n' && str[1] == '\n')) {
+	if c := s.marker(); !s.atLineStart(str) || c < '0' || c > '9' {
 		return nil
 	}
-	if tok := orderedListMatcher(str); tok != nil {
-		s.inOl = true
-		return tok
+	groups := orderedListRe.FindStringSubmatch(str)
+	if len(groups) == 0 {
+		return nil
 	}
-	return nil
+	if !(s.pos == 0 || s.inList || strings.HasPrefix(str, "\n\n") || groups[2] == "1") {
+		return nil
+	}
+	s.inList = true
+	return &Token{ORDERED_LIST, groups[1], groups[0]}
 }
 
 var unorderedListMatcher = groupMatcher(
-	regexp.MustCompile(`^\n*([\t ]*)[*-][\t ]+`),
+	regexp.MustCompile(`^\n*([\t ]*)[*+-][\t ]+`),
 	UNORDERED_LIST,
 	false)
 
+// matchUnorderedList matches a bullet list marker at the start of a line.
 func (s *Scanner) matchUnorderedList(str string) *Token {
-	if !(s.pos == 0 || s.inUl || (len(str) >= 2 && str[0] == '\n' && str[1] == '\n')) {
+	if c := s.marker(); !s.atLineStart(str) || (c != '*' && c != '+' && c != '-') {
 		return nil
 	}
 	if tok := unorderedListMatcher(str); tok != nil {
-		s.inUl = true
+		s.inList = true
 		return tok
 	}
 	return nil
 }
 
-var tdMatcher = groupMatcher(regexp.MustCompile(`^\s*(.*?)\s*[|]`), TD, true)
+var blockquoteMatcher = groupMatcher(
+	regexp.MustCompile(`^\n*([\t ]*)>[\t ]?`),
+	BLOCKQUOTE,
+	false)
+
+func (s *Scanner) matchBlockquote(str string) *Token {
+	if s.inTd || !s.atLineStart(str) || s.marker() != '>' {
+		return nil
+	}
+	return blockquoteMatcher(str)
+}
+
+func (s *Scanner) atLineStart(str string) bool {
+	return s.pos == 0 || s.src[s.pos-1] == '\n' || strings.HasPrefix(str, "\n")
+}
 
 func (s *Scanner) matchTD(str string) *Token {
-	for i, r := range str {
-		if r == '\n' {
-			if i > 0 && s.inTd {
-				return &Token{TD, strings.TrimSpace(str[:i]), str[:i]}
+	if s.pos > s.cellEnd {
+		s.cellEnd = s.pos + cellEnd(str)
+	}
+	i := s.cellEnd - s.pos
+	switch {
+	case i == len(str):
+		if s.inTd {
+			s.inTd = false
+			return &Token{TD, strings.TrimSpace(str), str}
+		}
+	case str[i] == '|':
+		s.inTd = true
+		return &Token{TD, strings.TrimSpace(str[:i]), str[:i+1]}
+	case i > 0 && s.inTd:
+		return &Token{TD, strings.TrimSpace(str[:i]), str[:i]}
+	}
+	return nil
+}
+
+// cellEnd returns the index of the first newline or unescaped | in s.
+func cellEnd(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' || s[i] == '|' && !(i > 0 && s[i-1] == '\\') {
+			return i
+		}
+	}
+	return len(s)
+}
+
+var (
+	admonitionStart = regexp.MustCompile(`^[\t ]*(:{3,}[\t ]*|!!![\t ]+|\?\?\?\+?[\t ]+)([A-Za-z][\w-]*)[\t ]*([^\n]*)`)
+	containerFence  = regexp.MustCompile(`^[\t ]*:{3,}[\t ]*(\S?)`)
+)
+
+// matchAdmonition matches a container with a type and an optional title,
+// either fenced by lines of colons, as in ":::note Title" and ":::", or
+// started by "!!! note" and followed by indented lines. As in Python-Markdown,
+// "!!!" must be followed by a space, so "!!!Wow" is text. A container started
+// by "???" instead is collapsible, and "???+" starts it expanded. The Lit of
+// the token is the type and title, then a newline and the content.
+func (s *Scanner) matchAdmonition(str string) *Token {
+	if c := s.marker(); !s.indented || (c != ':' && c != '!' && c != '?') {
+		return nil
+	}
+	groups := admonitionStart.FindStringSubmatch(str)
+	if groups == nil {
+		return nil
+	}
+	typ, header := TokenType(ADMONITION), groups[2]+" "+groups[3]
+	if groups[1][0] == '?' {
+		typ = DETAILS
+	}
+	start := lineEnd(str, 0) + 1
+	if start > len(str) {
+		return &Token{typ, header, str}
+	}
+	var end, next int
+	if groups[1][0] != ':' {
+		end, next = indentedEnd(str, start)
+		return &Token{typ, header + "\n" + dedentBlock(str[start:end]), str[:next]}
+	}
+	end, next = containerEnd(str, start)
+	return &Token{typ, header + "\n" + str[start:end], str[:next]}
+}
+
+// containerEnd returns the end of the content of a container fenced by
+// colons, starting at start, and the end of its closing fence. Containers
+// nested inside it have fences too, and fences in code blocks are ignored.
+// Without a closing fence, the container ends at the end of s.
+func containerEnd(s string, start int) (int, int) {
+	depth, code := 1, false
+	for i := start; i < len(s); {
+		end := lineEnd(s, i)
+		line := s[i:end]
+		if strings.HasPrefix(strings.TrimLeft(line, "\t "), "```") {
+			code = !code
+		} else if m := containerFence.FindStringSubmatch(line); m != nil && !code {
+			if m[1] != "" {
+				depth++
+			} else if depth--; depth == 0 {
+				return max(i-1, start), min(end+1, len(s))
 			}
-			return nil
 		}
-		if r == '|' {
-			if tok := tdMatcher(str[:i+1]); tok != nil {
-				s.inTd = true
-				return tok
+		i = end + 1
+	}
+	return len(s), len(s)
+}
+
+// indentedEnd returns the end of the indented lines starting at start, not
+// counting blank lines after them, and the start of the line after them.
+func indentedEnd(s string, start int) (int, int) {
+	end, next := start, start
+	for i := start; i < len(s); {
+		lineEnd := lineEnd(s, i)
+		line := s[i:lineEnd]
+		if strings.TrimSpace(line) != "" {
+			if !strings.HasPrefix(line, "    ") && !strings.HasPrefix(line, "\t") {
+				break
 			}
+			end, next = lineEnd, min(lineEnd+1, len(s))
 		}
+		i = lineEnd + 1
+	}
+	if end == start {
+		return start, start
 	}
-	if s.inTd {
-		s.inTd = false
-		return &Token{TD, strings.TrimSpace(str), str}
+	return end, next
+}
+
+// dedentBlock removes a tab or up to four spaces from the start of each line.
+func dedentBlock(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "\t") {
+			lines[i] = line[1:]
+			continue
+		}
+		n := 0
+		for n < 4 && n < len(line) && line[n] == ' ' {
+			n++
+		}
+		lines[i] = line[n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	startTagRe     = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9-]*)(?:\s[^<>]*)?>`)
+	markdownAttrRe = regexp.MustCompile(`\smarkdown\s*=\s*["']?([01])\b`)
+)
+
+// rawTextTag is the set of elements whose content is never Markdown, unless
+// they have a markdown="1" attribute.
+var rawTextTag = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"pre":      true,
+	"textarea": true,
+}
+
+// matchRawHTML matches HTML whose content isn't Markdown: a raw directive
+// and its content, or a script, style, pre or textarea element, or any
+// element with a markdown="0" attribute.
+func (s *Scanner) matchRawHTML(str string) *Token {
+	if end := rawDirectiveEnd(str); end > 0 {
+		return &Token{RAW, str[:end], str[:end]}
+	}
+	if end := s.rawElementEnd(str); end > 0 {
+		return &Token{RAW_HTML, str[:end], str[:end]}
 	}
 	return nil
 }
+
+// rawElementEnd returns the end of the HTML element at the start of str if
+// its content isn't Markdown, or -1. An element without an end tag ends at
+// the next blank line, as its block would.
+func (s *Scanner) rawElementEnd(str string) int {
+	if !strings.HasPrefix(str, "<") {
+		return -1
+	}
+	m := startTagRe.FindStringSubmatch(str)
+	if m == nil {
+		return -1
+	}
+	name := strings.ToLower(m[1])
+	if attr := markdownAttrRe.FindStringSubmatch(m[0]); attr != nil && attr[1] == "1" ||
+		attr == nil && !rawTextTag[name] {
+		return -1
+	}
+	if strings.HasSuffix(m[0], "/>") {
+		return len(m[0])
+	}
+	// The end tag is only searched for if there's one after the element,
+	// so that unclosed elements don't take quadratic time.
+	offset := len(s.src) - len(str)
+	if s.lastEndTag(name) < offset {
+		return s.blankLine(offset+len(m[0])) - offset
+	}
+	// Elements of the same name nested inside it are skipped, except in raw
+	// text, where there are no elements.
+	depth := 0
+	for i := len(m[0]); i < len(str); i++ {
+		j := strings.IndexByte(str[i:], '<')
+		if j < 0 {
+			break
+		}
+		i += j
+		if i+1 < len(str) && str[i+1] == '/' && tagNameEnd(str, i+2, name) > 0 {
+			if depth == 0 {
+				return min(nextByte(str, i, '>')+1, len(str))
+			}
+			depth--
+		} else if !rawTextTag[name] && tagNameEnd(str, i+1, name) > 0 {
+			depth++
+		}
+	}
+	return s.blankLine(offset+len(m[0])) - offset
+}
+
+// lastEndTag returns the offset in the source of the last end tag of the
+// element name, or -1. The end tags of every element are found once.
+func (s *Scanner) lastEndTag(name string) int {
+	if s.endTags == nil {
+		s.endTags = make(map[string]int)
+		for i := strings.Index(s.src, "</"); i >= 0; {
+			j := i + 2
+			for j < len(s.src) && (isASCIILetter(s.src[j]) || s.src[j] >= '0' && s.src[j] <= '9' || s.src[j] == '-') {
+				j++
+			}
+			s.endTags[strings.ToLower(s.src[i+2:j])] = i
+			k := strings.Index(s.src[j:], "</")
+			if k < 0 {
+				break
+			}
+			i = j + k
+		}
+	}
+	if i, ok := s.endTags[name]; ok {
+		return i
+	}
+	return -1
+}
+
+// blankLine returns the offset of the next blank line at or after pos, or
+// the end of the source.
+func (s *Scanner) blankLine(pos int) int {
+	if s.blankEnd < pos {
+		s.blankEnd = nextString(s.src, pos, "\n\n")
+	}
+	return s.blankEnd
+}
+
+// tagNameEnd returns the end of the tag name at s[i] if it's name, or -1.
+func tagNameEnd(s string, i int, name string) int {
+	end := i + len(name)
+	if end > len(s) || !strings.EqualFold(s[i:end], name) {
+		return -1
+	}
+	if end < len(s) && strings.IndexByte(" \t\n/>", s[end]) < 0 {
+		return -1
+	}
+	return end
+}
+
+// rawDirectiveRe matches the start of a raw directive, as in <!--raw--> or
+// <!--raw escape-->.
+var rawDirectiveRe = regexp.MustCompile(`^<!--raw(?:\s[^>]*)?-->`)
+
+// rawDirectiveEnd returns the end of the closing <!--/raw--> of the raw
+// directive at the start of s, or the end of s if there isn't one, or -1 if
+// there's no raw directive.
+func rawDirectiveEnd(s string) int {
+	if !strings.HasPrefix(s, "<!--") {
+		return -1
+	}
+	start := rawDirectiveRe.FindString(s)
+	if start == "" {
+		return -1
+	}
+	if i := strings.Index(s[len(start):], rawDirectiveClose); i >= 0 {
+		return len(start) + i + len(rawDirectiveClose)
+	}
+	return len(s)
+}
+
+const rawDirectiveClose = "<!--/raw-->"
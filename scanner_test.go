@@ -71,6 +71,30 @@ var scannerCases = []*scannerCase{
 	{"<!--comment-->", []TokenType{
 		HTML_TAG,
 	}},
+	{"*see [the docs](www.example.com)* `*`", []TokenType{
+		EM, TEXT, CODE,
+	}},
+	{"> A quote\n> more", []TokenType{
+		BLOCKQUOTE, TEXT, BLOCKQUOTE, TEXT,
+	}},
+	{":::note Title\nSome *text*\n:::\n!!! tip\n    More\nAfter", []TokenType{
+		ADMONITION, ADMONITION, TEXT,
+	}},
+	{"???+ Solution\n    x\n???\n", []TokenType{
+		DETAILS, TEXT, NEWLINE,
+	}},
+	{"*a <pre>b*</pre>\n<div markdown=0>\n# c\n</div>", []TokenType{
+		TEXT, RAW_HTML, NEWLINE, RAW_HTML,
+	}},
+	{"*a <!--raw-->b* <pre><!--/raw-->*c*", []TokenType{
+		TEXT, RAW, EM,
+	}},
+	{"$$x$$ \\(y\\) $5 and $10\n\\[\nz\n\\]", []TokenType{
+		MATH_BLOCK, TEXT, MATHML, TEXT, NEWLINE, MATH_BLOCK,
+	}},
+	{"$$ F = ma $$ {#eq:newton}\n[@eq:newton]", []TokenType{
+		MATH_BLOCK, NEWLINE, LINK_TEXT,
+	}},
 }
 
 func TestScanner(t *testing.T) {
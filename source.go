@@ -0,0 +1,271 @@
+package markdown
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"golang.org/x/net/html"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sourceLanguages maps file extensions to the languages of their code.
+var sourceLanguages = map[string]string{
+	".go":   "go",
+	".js":   "js",
+	".mjs":  "js",
+	".py":   "python",
+	".sh":   "sh",
+	".bash": "sh",
+	".json": "json",
+	".html": "html",
+	".htm":  "html",
+	".xml":  "xml",
+	".md":   "markdown",
+}
+
+// parseCodeDirective parses a code directive, which shows code from a file
+// in Options.FS as a code block, as in <!--code src="pkg/file.go"-->. Its
+// path is resolved as it is for an include directive. The lines attribute
+// selects ranges of lines, as in lines="10-40", and the symbol attribute
+// selects a declaration in a Go file, as in symbol="Parser.parseTD" for a
+// method, in which case the lines are counted from the start of the
+// declaration. The language is found from the file's extension unless
+// there's a lang attribute, and the other attributes are passed on to the
+// code block, so that linenos and title work as they do after a code fence.
+// Numbered lines must be in contiguous ranges.
+func (p *Parser) parseCodeDirective(attrs []html.Attribute) {
+	var src, lines, symbol, lang string
+	var info []string
+	start, linenos := 1, false
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "src":
+			src = attr.Val
+		case "lines":
+			lines = attr.Val
+		case "symbol":
+			symbol = attr.Val
+		case "lang":
+			lang = attr.Val
+		case "linenos":
+			linenos = attr.Val != "false"
+			info = append(info, infoAttr(attr))
+		default:
+			info = append(info, infoAttr(attr))
+		}
+	}
+	if src == "" {
+		p.warnf(p.pos-1, "code directive has no src")
+		return
+	}
+	file, err := p.resolvePath(src)
+	if err != nil {
+		p.warnf(p.pos-1, "%v", err)
+		return
+	}
+	buf, err := fs.ReadFile(p.opts.FS, file)
+	if err != nil {
+		p.warnf(p.pos-1, "can't read %s: %v", src, err)
+		return
+	}
+	code := string(buf)
+	if symbol != "" {
+		code, start, err = goDecl(src, buf, symbol)
+		if err != nil {
+			p.warnf(p.pos-1, "%v", err)
+			return
+		}
+	}
+	if lines != "" {
+		ranges, ok := lineRanges(lines)
+		if !ok || len(ranges) == 0 {
+			p.warnf(p.pos-1, "bad lines %q", lines)
+			return
+		}
+		// Lines are numbered from the start of the first range, so the
+		// ranges must follow on from each other.
+		for i := 1; i < len(ranges); i++ {
+			if linenos && ranges[i][0] != ranges[i-1][1]+1 {
+				p.warnf(p.pos-1, "can't number lines %q: they aren't contiguous", lines)
+				return
+			}
+		}
+		code = selectLines(code, ranges)
+		start += ranges[0][0] - 1
+	}
+	code = trimIndent(code)
+	if lang == "" {
+		lang = sourceLanguages[path.Ext(src)]
+	}
+	if !hasAttr(attrs, "linenostart") {
+		info = append(info, "linenostart="+strconv.Itoa(start))
+	}
+	p.block()
+	p.parseCodeBlock(&Token{CODE_BLOCK, lang + " {" + strings.Join(info, " ") + "}\n" + code, ""})
+}
+
+// infoAttr writes an attribute as it would be in the info string after a
+// code fence.
+func infoAttr(attr html.Attribute) string {
+	switch {
+	case attr.Val == "":
+		return attr.Key
+	case !strings.Contains(attr.Val, `"`):
+		return attr.Key + `="` + attr.Val + `"`
+	}
+	return attr.Key + `='` + attr.Val + `'`
+}
+
+func hasAttr(attrs []html.Attribute, key string) bool {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// selectLines returns the lines of s in the ranges, which are numbered from
+// 1. Ranges past the end of s are cut short.
+func selectLines(s string, ranges [][2]int) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	var selected []string
+	for _, r := range ranges {
+		from, to := r[0], r[1]
+		if to > len(lines) {
+			to = len(lines)
+		}
+		if from <= to {
+			selected = append(selected, lines[from-1:to]...)
+		}
+	}
+	return strings.Join(selected, "\n")
+}
+
+// trimIndent removes the indentation common to the lines of s that aren't
+// blank.
+func trimIndent(s string) string {
+	lines := strings.Split(s, "\n")
+	indent, first := "", true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lineIndent := line[:len(line)-len(strings.TrimLeft(line, "\t "))]
+		if first {
+			indent, first = lineIndent, false
+		}
+		for !strings.HasPrefix(lineIndent, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, indent)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// goDecl returns the source of the declaration of symbol in a Go file, with
+// its doc comment, and the line it starts on. A method is named with its
+// receiver's type, as in Parser.parseTD.
+func goDecl(filename string, src []byte, symbol string) (string, int, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return "", 0, fmt.Errorf("can't parse %s: %v", filename, err)
+	}
+	recv, name := "", symbol
+	if i := strings.IndexByte(symbol, '.'); i >= 0 {
+		recv, name = symbol[:i], symbol[i+1:]
+	}
+	var node ast.Node
+	var doc *ast.CommentGroup
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Name.Name == name && receiverType(decl) == recv {
+				node, doc = decl, decl.Doc
+			}
+		case *ast.GenDecl:
+			if recv != "" {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				if !declares(spec, name) {
+					continue
+				}
+				// A declaration in a group is shown without the rest of
+				// the group.
+				node, doc = decl, decl.Doc
+				if decl.Lparen.IsValid() {
+					node, doc = spec, specDoc(spec)
+				}
+			}
+		}
+	}
+	if node == nil {
+		return "", 0, fmt.Errorf("%s has no declaration of %s", filename, symbol)
+	}
+	start := node.Pos()
+	if doc != nil {
+		start = doc.Pos()
+	}
+	// The declaration is taken from the start of its line, so that the
+	// indentation of a declaration in a group can be removed.
+	from, to := fset.Position(start), fset.Position(node.End())
+	return string(src[from.Offset-from.Column+1 : to.Offset]), from.Line, nil
+}
+
+// receiverType returns the name of the type of a method's receiver, or ""
+// for a function.
+func receiverType(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return ""
+	}
+	typ := fn.Recv.List[0].Type
+	for {
+		switch t := typ.(type) {
+		case *ast.StarExpr:
+			typ = t.X
+		case *ast.IndexExpr:
+			typ = t.X
+		case *ast.IndexListExpr:
+			typ = t.X
+		case *ast.ParenExpr:
+			typ = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// declares reports whether a type, const or var spec declares name.
+func declares(spec ast.Spec, name string) bool {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Name.Name == name
+	case *ast.ValueSpec:
+		for _, ident := range spec.Names {
+			if ident.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func specDoc(spec ast.Spec) *ast.CommentGroup {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Doc
+	case *ast.ValueSpec:
+		return spec.Doc
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package markdown
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+var sourceFS = fstest.MapFS{
+	"pkg/calc.go": {Data: []byte(`package calc
+
+import "fmt"
+
+// Calc adds up numbers.
+type Calc struct {
+	total int
+}
+
+// Add adds n.
+func (c *Calc) Add(n int) {
+	c.total += n
+}
+
+const (
+	// Zero is nothing.
+	Zero = 0
+	One  = 1
+)
+
+func Print(c Calc) {
+	fmt.Println(c.total)
+}
+`)},
+	"run.sh": {Data: []byte("echo a\necho b\necho c\n")},
+}
+
+func TestCodeDirective(t *testing.T) {
+	cases := []struct {
+		input, want string
+		diags       []string
+	}{
+		{
+			`<!--code src="run.sh" lines="2-3"-->`,
+			"<pre><code class=\"sh\">echo b\necho c</code></pre>",
+			nil,
+		},
+		{
+			`<!--code src="pkg/calc.go" symbol="Calc.Add" linenos title="calc.go"-->`,
+			"<figure class=\"code-block\">\n" +
+				"\t<figcaption>calc.go</figcaption>\n" +
+				"\t<pre><code class=\"go\">" +
+				"<span class=\"line\"><span class=\"line-number\">10</span>// Add adds n.\n</span>" +
+				"<span class=\"line\"><span class=\"line-number\">11</span>func (c *Calc) Add(n int) {\n</span>" +
+				"<span class=\"line\"><span class=\"line-number\">12</span>\tc.total += n\n</span>" +
+				"<span class=\"line\"><span class=\"line-number\">13</span>}</span>" +
+				"</code></pre>\n" +
+				"</figure>",
+			nil,
+		},
+		{
+			`<!--code src="pkg/calc.go" symbol="Zero"--> <!--code src="pkg/calc.go" symbol="Calc" lines="2-3"-->`,
+			"<pre><code class=\"go\">// Zero is nothing.\nZero = 0</code></pre>\n" +
+				"<pre><code class=\"go\">type Calc struct {\n\ttotal int</code></pre>",
+			nil,
+		},
+		{
+			"Text\n<!--code src=\"pkg/calc.go\" symbol=\"Print\" lines=\"2\" lang=\"text\"-->",
+			"<p>Text\n</p>\n<pre><code class=\"text\">fmt.Println(c.total)</code></pre>",
+			nil,
+		},
+		{
+			`<!--code src="missing.go"--><!--code src="pkg/calc.go" symbol="Calc.Sub"--><!--code src="run.sh" lines="x"-->`,
+			"",
+			[]string{
+				"1:1: can't read missing.go: open missing.go: file does not exist",
+				"1:29: pkg/calc.go has no declaration of Calc.Sub",
+				"1:76: bad lines \"x\"",
+			},
+		},
+		{
+			`<!--code src="run.sh" lines="1-2,3" linenos--><!--code src="run.sh" lines="1,3" linenos-->`,
+			"<pre><code class=\"sh\">" +
+				"<span class=\"line\"><span class=\"line-number\">1</span>echo a\n</span>" +
+				"<span class=\"line\"><span class=\"line-number\">2</span>echo b\n</span>" +
+				"<span class=\"line\"><span class=\"line-number\">3</span>echo c</span>" +
+				"</code></pre>",
+			[]string{"1:47: can't number lines \"1,3\": they aren't contiguous"},
+		},
+	}
+	for _, c := range cases {
+		got, diags, err := MarkdownE(c.input, &Options{FS: sourceFS})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("got\n%s\nwant\n%s", got, c.want)
+		}
+		var msgs []string
+		for _, d := range diags {
+			msgs = append(msgs, d.String())
+		}
+		if !reflect.DeepEqual(msgs, c.diags) {
+			t.Errorf("%q: got diagnostics %q, want %q", c.input, msgs, c.diags)
+		}
+	}
+}
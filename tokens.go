@@ -38,6 +38,12 @@ const (
 	UNORDERED_LIST
 	MATHML
 	TD
+	BLOCKQUOTE
+	MATH_BLOCK
+	ADMONITION
+	DETAILS
+	RAW_HTML
+	RAW
 )
 
 var tokenNames = map[TokenType]string{
@@ -62,6 +68,12 @@ var tokenNames = map[TokenType]string{
 	UNORDERED_LIST: "UNORDERED_LIST",
 	MATHML:         "MATHML",
 	TD:             "TD",
+	BLOCKQUOTE:     "BLOCKQUOTE",
+	MATH_BLOCK:     "MATH_BLOCK",
+	ADMONITION:     "ADMONITION",
+	DETAILS:        "DETAILS",
+	RAW_HTML:       "RAW_HTML",
+	RAW:            "RAW",
 }
 
 func (t TokenType) String() string {
@@ -88,4 +100,7 @@ var blockToken = map[TokenType]bool{
 	CODE_BLOCK:     true,
 	ORDERED_LIST:   true,
 	UNORDERED_LIST: true,
+	BLOCKQUOTE:     true,
+	ADMONITION:     true,
+	DETAILS:        true,
 }